@@ -1,13 +1,17 @@
 package auth
 
 import (
+	"context"
 	"errors"
-	"io"
+	"net"
 )
 
 // ErrUnSupportedMethod returns when method has not been supported.
 var ErrUnSupportedMethod = errors.New("unsupported authentication method")
 
+// ErrAuthenticationFailed returns when the client has sent invalid credentials.
+var ErrAuthenticationFailed = errors.New("authentication failed")
+
 // Method represents auth method.
 type Method byte
 
@@ -30,6 +34,38 @@ const (
 	MethodNoAcceptableMethods Method = 0xff
 )
 
+// UsernamePasswordVersion represents the version of username/password subnegotiation.
+// See: https://tools.ietf.org/html/rfc1929
+const UsernamePasswordVersion = 0x01
+
+// Result represents the outcome of successful authentication.
+type Result struct {
+	// User is the principal validated by the authenticator.
+	// It is empty if the method does not identify the client.
+	User string
+
+	// Conn, if non-nil, is used instead of the original connection for the
+	// rest of the session. This allows the method to encapsulate the
+	// subsequent data stream, e.g. for integrity or confidentiality.
+	Conn net.Conn
+}
+
+// Authenticator performs the method-specific subnegotiation after the
+// authentication method has been selected. It may return nil Result if
+// there is nothing to report. On failure, it may return Result along with
+// the error to report the principal who attempted to authenticate.
 type Authenticator interface {
-	Authenticate(conn io.ReadWriter) error
+	Authenticate(ctx context.Context, conn net.Conn) (*Result, error)
+}
+
+var _ Authenticator = (FuncAuthenticator)(nil)
+
+// FuncAuthenticator is an adapter to allow the use of ordinary functions as
+// Authenticator. It is useful to implement arbitrary subnegotiation such as
+// calling an external service.
+type FuncAuthenticator func(ctx context.Context, conn net.Conn) (*Result, error)
+
+// Authenticate calls f(ctx, conn).
+func (f FuncAuthenticator) Authenticate(ctx context.Context, conn net.Conn) (*Result, error) {
+	return f(ctx, conn)
 }
@@ -0,0 +1,135 @@
+// Package gssapi defines the interface between the SOCKS5 GSSAPI
+// authentication method and a GSS-API mechanism such as Kerberos.
+// See: https://tools.ietf.org/html/rfc1961
+package gssapi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version represents the version of GSS-API subnegotiation messages.
+const Version = 0x01
+
+// MessageType represents MTYP field of GSS-API subnegotiation messages.
+type MessageType byte
+
+const (
+	// MessageAuthentication represents context establishment message.
+	MessageAuthentication MessageType = 0x01
+
+	// MessageProtection represents protection level negotiation message.
+	MessageProtection MessageType = 0x02
+
+	// MessageEncapsulation represents per-message protected data.
+	MessageEncapsulation MessageType = 0x03
+
+	// MessageAbort represents the failure of subnegotiation.
+	MessageAbort MessageType = 0xff
+)
+
+// ProtectionLevel represents the security level negotiated after
+// the context has been established.
+type ProtectionLevel byte
+
+const (
+	// ProtectionNone represents no per-message protection. This is not
+	// defined in RFC 1961, but is used by implementations to keep the
+	// channel clear after authentication.
+	ProtectionNone ProtectionLevel = 0x00
+
+	// ProtectionIntegrity represents required per-message integrity.
+	ProtectionIntegrity ProtectionLevel = 0x01
+
+	// ProtectionConfidentiality represents required per-message
+	// integrity and confidentiality.
+	ProtectionConfidentiality ProtectionLevel = 0x02
+
+	// ProtectionSelective represents selective per-message integrity
+	// or confidentiality based on local client and server configurations.
+	ProtectionSelective ProtectionLevel = 0x03
+)
+
+// ErrAborted returns when the peer has aborted subnegotiation.
+var ErrAborted = errors.New("gssapi: subnegotiation aborted")
+
+// Provider creates acceptor-side security contexts. It is implemented by
+// a GSS-API mechanism binding such as Kerberos.
+type Provider interface {
+	NewContext() (Context, error)
+}
+
+// Context represents an acceptor-side security context.
+type Context interface {
+	// Accept processes a token received from the client like
+	// gss_accept_sec_context. It returns a token to send back to the
+	// client, which may be empty, and reports whether the context has
+	// been established.
+	Accept(token []byte) (out []byte, established bool, err error)
+
+	// SourceName returns the name of the authenticated client principal.
+	// It is called after the context has been established.
+	SourceName() string
+
+	// Wrap protects msg like gss_wrap (formerly gss_seal).
+	Wrap(msg []byte, confidential bool) ([]byte, error)
+
+	// Unwrap verifies and returns the message protected by the peer like
+	// gss_unwrap (formerly gss_unseal).
+	Unwrap(token []byte) ([]byte, error)
+}
+
+// ReadMessage reads a GSS-API subnegotiation message.
+//
+// +------+------+------+.......................+
+// + ver  | mtyp | len  |       token           |
+// +------+------+------+.......................+
+// + 0x01 | 0x01 | 0x02 | up to 2^16 - 1 octets |
+// +------+------+------+.......................+
+func ReadMessage(r io.Reader) (MessageType, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != Version {
+		return 0, nil, fmt.Errorf("unsupported gssapi version: %d", header[0])
+	}
+	mtyp := MessageType(header[1])
+	if mtyp == MessageAbort {
+		return mtyp, nil, ErrAborted
+	}
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	token := make([]byte, int(header[0])<<8|int(header[1]))
+	if _, err := io.ReadFull(r, token); err != nil {
+		return 0, nil, err
+	}
+	return mtyp, token, nil
+}
+
+// WriteMessage writes a GSS-API subnegotiation message.
+func WriteMessage(w io.Writer, mtyp MessageType, token []byte) error {
+	if len(token) > 0xffff {
+		return fmt.Errorf("gssapi token is too long: %d", len(token))
+	}
+	msg := make([]byte, 0, 4+len(token))
+	msg = append(msg, Version, byte(mtyp), byte(len(token)>>8), byte(len(token)))
+	msg = append(msg, token...)
+	_, err := w.Write(msg)
+	return err
+}
+
+// WriteAbort writes the abort message.
+//
+// +------+------+
+// + ver  | mtyp |
+// +------+------+
+// + 0x01 | 0xff |
+// +------+------+
+func WriteAbort(w io.Writer) error {
+	_, err := w.Write([]byte{Version, byte(MessageAbort)})
+	return err
+}
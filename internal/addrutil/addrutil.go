@@ -36,7 +36,9 @@ func SplitHostPort(address string) (string, int, error) {
 	if err != nil {
 		return "", 0, err
 	}
-	if 1 > portnum || portnum > 0xffff {
+	// port 0 is allowed such as BIND request which
+	// does not know the port of the peer.
+	if 0 > portnum || portnum > 0xffff {
 		return "", 0, fmt.Errorf("port number out of range: %d", portnum)
 	}
 	return host, portnum, nil
@@ -44,7 +46,7 @@ func SplitHostPort(address string) (string, int, error) {
 
 func Read(conn io.Reader) (*address.Info, error) {
 	aTypBuf := make([]byte, 1)
-	if _, err := conn.Read(aTypBuf); err != nil {
+	if _, err := io.ReadFull(conn, aTypBuf); err != nil {
 		return nil, err
 	}
 	aTyp := address.Type(aTypBuf[0])
@@ -67,24 +69,23 @@ func readHost(conn io.Reader, aTyp address.Type) ([]byte, error) {
 	switch aTyp {
 	case address.TypeIPv4:
 		ip := make([]byte, net.IPv4len)
-		if _, err := conn.Read(ip); err != nil {
+		if _, err := io.ReadFull(conn, ip); err != nil {
 			return nil, err
 		}
 		return ip, nil
 	case address.TypeIPv6:
 		ip := make([]byte, net.IPv6len)
-		if _, err := conn.Read(ip); err != nil {
+		if _, err := io.ReadFull(conn, ip); err != nil {
 			return nil, err
 		}
 		return ip, nil
 	case address.TypeFQDN:
 		fqdnLen := make([]byte, 1)
-		if _, err := conn.Read(fqdnLen); err != nil {
+		if _, err := io.ReadFull(conn, fqdnLen); err != nil {
 			return nil, err
 		}
-		len := int(fqdnLen[0])
-		fqdn := make([]byte, len)
-		if _, err := conn.Read(fqdn); err != nil {
+		fqdn := make([]byte, int(fqdnLen[0]))
+		if _, err := io.ReadFull(conn, fqdn); err != nil {
 			return nil, err
 		}
 		return fqdn, nil
@@ -95,7 +96,7 @@ func readHost(conn io.Reader, aTyp address.Type) ([]byte, error) {
 func readPort(conn io.Reader) (int, error) {
 	// Read the port
 	port := make([]byte, 2)
-	_, err := conn.Read(port)
+	_, err := io.ReadFull(conn, port)
 	if err != nil {
 		return 0, err
 	}
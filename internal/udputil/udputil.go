@@ -1,12 +1,17 @@
 package udputil
 
 import (
+	"errors"
 	"fmt"
 	"net"
 
 	"github.com/Code-Hex/socks5/address"
 )
 
+// ErrFragmented returns when the datagram is a fragment. Fragmentation is not
+// supported, so such datagrams must be dropped.
+var ErrFragmented = errors.New("fragmented datagram is not supported")
+
 // CreateFrame creates udp frame of socks5
 //
 // +-----+------+------+-----------+---------+--------+
@@ -44,28 +49,32 @@ func ExtractData(frame []byte) ([]byte, *address.Info, error) {
 	// Implementation of fragmentation is optional; an implementation that
 	// does not support fragmentation MUST drop any datagram whose FRAG
 	// field is other than X'00'.
-	fragmentation := frame[2]
-	if fragmentation != 0 {
-		return nil, nil, fmt.Errorf("unsupported fragmentation: %d", fragmentation)
+	if frame[2] != 0 {
+		return nil, nil, ErrFragmented
 	}
 
 	aTyp := address.Type(frame[3])
+	start := 4
 	switch aTyp {
 	case address.TypeIPv4:
 		l += net.IPv4len
 	case address.TypeIPv6:
 		l += net.IPv6len
 	case address.TypeFQDN:
+		start++
 		l += 1 + int(frame[4]) // size of length field + length of fqdn
 	default:
 		return nil, nil, &address.Unrecognized{
 			Type: aTyp,
 		}
 	}
+	if l > len(frame) {
+		return nil, nil, fmt.Errorf("unexpected data format: %v", frame)
+	}
 
 	// extract data
 	return frame[l:], &address.Info{
-		Host: frame[4 : l-2],
+		Host: frame[start : l-2],
 		Port: (int(frame[l-2]) << 8) | int(frame[l-1]),
 		Type: aTyp,
 	}, nil
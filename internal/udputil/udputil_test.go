@@ -0,0 +1,50 @@
+package udputil
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Code-Hex/socks5/address"
+)
+
+func TestExtractData(t *testing.T) {
+	cases := []struct {
+		name string
+		aTyp address.Type
+		host address.Host
+	}{
+		{"ipv4", address.TypeIPv4, address.Host{127, 0, 0, 1}},
+		{"ipv6", address.TypeIPv6, address.Host{15: 1}},
+		{"fqdn", address.TypeFQDN, address.Host("localhost")},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			frame := CreateFrame(tc.aTyp, 1201, tc.host, []byte("data"))
+			data, info, err := ExtractData(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "data" {
+				t.Fatalf("want data, but got %q", data)
+			}
+			if info.Type != tc.aTyp || info.Port != 1201 || info.Host.String() != tc.host.String() {
+				t.Fatalf("unexpected address: %+v", info)
+			}
+		})
+	}
+}
+
+func TestExtractData_Fragmented(t *testing.T) {
+	frame := CreateFrame(address.TypeIPv4, 1201, address.Host{127, 0, 0, 1}, []byte("data"))
+	frame[2] = 1
+	if _, _, err := ExtractData(frame); !errors.Is(err, ErrFragmented) {
+		t.Fatalf("want %v, but got %v", ErrFragmented, err)
+	}
+}
+
+func TestExtractData_Truncated(t *testing.T) {
+	frame := CreateFrame(address.TypeFQDN, 1201, address.Host("localhost"), nil)
+	if _, _, err := ExtractData(frame[:8]); err == nil {
+		t.Fatal("expected error for truncated datagram")
+	}
+}
@@ -0,0 +1,127 @@
+// Package metrics exports metrics of a SOCKS5 server to Prometheus.
+//
+// The collector is wired through the hooks of server.Config, so the server
+// package itself does not depend on Prometheus:
+//
+//	c := metrics.NewCollector()
+//	prometheus.MustRegister(c)
+//	conf := &server.Config{...}
+//	c.Instrument(conf)
+//	srv := server.New(conf)
+package metrics
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/Code-Hex/socks5/auth"
+	"github.com/Code-Hex/socks5/server"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "socks5"
+
+// Collector is a prometheus.Collector of server metrics.
+type Collector struct {
+	activeConns  prometheus.Gauge
+	conns        prometheus.Counter
+	bytes        *prometheus.CounterVec
+	authFailures prometheus.Counter
+	replies      *prometheus.CounterVec
+}
+
+// NewCollector returns a collector. It collects nothing until Instrument
+// is called with the config of a server.
+func NewCollector() *Collector {
+	return &Collector{
+		activeConns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_connections",
+			Help:      "Number of client connections being served.",
+		}),
+		conns: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_total",
+			Help:      "Total number of accepted client connections.",
+		}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transferred_bytes_total",
+			Help:      "Total number of relayed bytes by direction, up for client to destination.",
+		}, []string{"direction"}),
+		authFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_failures_total",
+			Help:      "Total number of failed method negotiations and authentications.",
+		}),
+		replies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "replies_total",
+			Help:      "Total number of replies to requests by reply code.",
+		}, []string{"code"}),
+	}
+}
+
+// Instrument sets the hooks of c to collect metrics of the server. Hooks
+// which have already been set are called as well. It must be called before
+// the config is passed to server.New.
+func (c *Collector) Instrument(conf *server.Config) {
+	connState := conf.ConnState
+	conf.ConnState = func(conn net.Conn, state server.ConnState) {
+		switch state {
+		case server.StateNew:
+			c.conns.Inc()
+			c.activeConns.Inc()
+		case server.StateClosed:
+			c.activeConns.Dec()
+		}
+		if connState != nil {
+			connState(conn, state)
+		}
+	}
+
+	onTransfer := conf.OnTransfer
+	conf.OnTransfer = func(up, down int64) {
+		c.bytes.WithLabelValues("up").Add(float64(up))
+		c.bytes.WithLabelValues("down").Add(float64(down))
+		if onTransfer != nil {
+			onTransfer(up, down)
+		}
+	}
+
+	onAuth := conf.OnAuth
+	conf.OnAuth = func(remoteAddr net.Addr, method auth.Method, user string, err error) {
+		if err != nil {
+			c.authFailures.Inc()
+		}
+		if onAuth != nil {
+			onAuth(remoteAddr, method, user, err)
+		}
+	}
+
+	accessLog := conf.AccessLog
+	conf.AccessLog = func(rec *server.AccessRecord) {
+		c.replies.WithLabelValues(strconv.Itoa(int(rec.Reply))).Inc()
+		if accessLog != nil {
+			accessLog(rec)
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.activeConns.Describe(ch)
+	c.conns.Describe(ch)
+	c.bytes.Describe(ch)
+	c.authFailures.Describe(ch)
+	c.replies.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.activeConns.Collect(ch)
+	c.conns.Collect(ch)
+	c.bytes.Collect(ch)
+	c.authFailures.Collect(ch)
+	c.replies.Collect(ch)
+}
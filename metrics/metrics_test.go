@@ -0,0 +1,142 @@
+package metrics_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/socks5/auth"
+	"github.com/Code-Hex/socks5/internal/addrutil"
+	"github.com/Code-Hex/socks5/metrics"
+	"github.com/Code-Hex/socks5/server"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollector(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	c := metrics.NewCollector()
+	registry.MustRegister(c)
+
+	closed := make(chan struct{}, 1)
+	conf := &server.Config{
+		ConnState: func(conn net.Conn, state server.ConnState) {
+			if state == server.StateClosed {
+				closed <- struct{}{}
+			}
+		},
+	}
+	c.Instrument(conf)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go server.New(conf).Serve(ln)
+
+	echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoLn.Close()
+	go func() {
+		conn, err := echoLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	// a session relaying 5 bytes each way.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	connect(t, conn, echoLn.Addr().(*net.TCPAddr))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection has not been closed")
+	}
+
+	want := map[string]float64{
+		"socks5_active_connections":                        0,
+		"socks5_connections_total":                         1,
+		"socks5_auth_failures_total":                       0,
+		`socks5_transferred_bytes_total{direction="up"}`:   5,
+		`socks5_transferred_bytes_total{direction="down"}`: 5,
+		`socks5_replies_total{code="0"}`:                   1,
+	}
+	got := gather(t, registry)
+	for name, w := range want {
+		if g, ok := got[name]; !ok || g != w {
+			t.Errorf("%s: want %v, but got %v (%v)", name, w, g, ok)
+		}
+	}
+}
+
+// connect sends CONNECT to dst on conn without authentication.
+func connect(t *testing.T, conn net.Conn, dst *net.TCPAddr) {
+	t.Helper()
+	if _, err := conn.Write([]byte{5, 1, byte(auth.MethodNotRequired)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	req := append([]byte{5, 1, 0, 1}, dst.IP.To4()...)
+	req = append(req, byte(dst.Port>>8), byte(dst.Port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[1] != 0 {
+		t.Fatalf("CONNECT failed with reply %d", header[1])
+	}
+	if _, err := addrutil.Read(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// gather returns the values of metrics in registry keyed by the name and
+// labels.
+func gather(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			key := mf.GetName()
+			for _, lp := range m.GetLabel() {
+				key += `{` + lp.GetName() + `="` + lp.GetValue() + `"}`
+			}
+			switch {
+			case m.GetCounter() != nil:
+				values[key] = m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				values[key] = m.GetGauge().GetValue()
+			}
+		}
+	}
+	return values
+}
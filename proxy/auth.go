@@ -1,7 +1,11 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 
 	"github.com/Code-Hex/socks5/auth"
 )
@@ -10,7 +14,55 @@ var _ auth.Authenticator = (*NotRequired)(nil)
 
 type NotRequired struct{}
 
-func (n *NotRequired) Authenticate(conn io.ReadWriter) error {
+func (n *NotRequired) Authenticate(ctx context.Context, conn net.Conn) (*auth.Result, error) {
 	// nothing to do
-	return nil
+	return nil, nil
+}
+
+var _ auth.Authenticator = (*UsernamePassword)(nil)
+
+// UsernamePassword represents username/password authentication.
+// See: https://tools.ietf.org/html/rfc1929
+type UsernamePassword struct {
+	Username string
+	Password string
+}
+
+func (u *UsernamePassword) Authenticate(ctx context.Context, conn net.Conn) (*auth.Result, error) {
+	if len(u.Username) == 0 || len(u.Username) > 255 {
+		return nil, errors.New("invalid username length")
+	}
+	if len(u.Password) == 0 || len(u.Password) > 255 {
+		return nil, errors.New("invalid password length")
+	}
+
+	// +----+------+----------+------+----------+
+	// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	// +----+------+----------+------+----------+
+	// | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	// +----+------+----------+------+----------+
+	b := make([]byte, 0, 3+len(u.Username)+len(u.Password))
+	b = append(b, auth.UsernamePasswordVersion, byte(len(u.Username)))
+	b = append(b, u.Username...)
+	b = append(b, byte(len(u.Password)))
+	b = append(b, u.Password...)
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	// +----+--------+
+	// |VER | STATUS |
+	// +----+--------+
+	// | 1  |   1    |
+	// +----+--------+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return nil, err
+	}
+	if b[0] != auth.UsernamePasswordVersion {
+		return nil, fmt.Errorf("unexpected username/password version %d", b[0])
+	}
+	if b[1] != 0 {
+		return nil, auth.ErrAuthenticationFailed
+	}
+	return &auth.Result{User: u.Username}, nil
 }
@@ -18,7 +18,8 @@ type Conn struct {
 	aTyp       address.Type
 }
 
-const maxBufferSize = 1024
+// maxBufferSize is large enough for any UDP datagram.
+const maxBufferSize = 64 * 1024
 
 func (c *Conn) Read(b []byte) (n int, err error) {
 	if c.UDPConn != nil {
@@ -31,8 +32,7 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 		if err != nil {
 			return 0, err
 		}
-		copy(b, buf)
-		return len(buf), nil
+		return copy(b, buf), nil
 	}
 	return c.Conn.Read(b)
 }
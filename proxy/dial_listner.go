@@ -1,33 +1,70 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"net"
+	"sync"
 )
 
+// errAlreadyAccepted returns when Accept is called more than once.
+// BIND accepts only one connection per listener.
+var errAlreadyAccepted = errors.New("bind listener has already accepted")
+
 type listner struct {
-	net.Listener
+	conn   *Conn
+	addr   net.Addr
 	dialer *DialListener
+
+	mu       sync.Mutex
+	accepted bool
 }
 
+// Accept waits for the second reply from the server, which means the peer
+// has connected to the bound address, and returns the connection relayed
+// to the peer.
 func (l *listner) Accept() (net.Conn, error) {
-	addr := l.Listener.Addr()
-	conn, err := l.dialer.Dial(addr.Network(), addr.String())
-	if err != nil {
-		return nil, err
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.accepted {
+		return nil, l.dialer.newError(errAlreadyAccepted, l.addr.Network(), l.addr.String())
 	}
-	if err := conn.Close(); err != nil {
-		return nil, err
+	l.accepted = true
+
+	if _, err := l.dialer.readReply(l.conn, make([]byte, 3)); err != nil {
+		l.conn.Close()
+		return nil, l.dialer.newError(err, l.addr.Network(), l.addr.String())
 	}
-	return l.Listener.Accept()
+	return l.conn, nil
+}
+
+// Close closes the listener. It does not close the connection which has
+// been returned by Accept.
+func (l *listner) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.accepted {
+		return nil
+	}
+	l.accepted = true
+	return l.conn.Close()
+}
+
+// Addr returns the address which the server is listening on.
+func (l *listner) Addr() net.Addr {
+	return l.addr
 }
 
+// Listen sends BIND request to the server. address is the expected address
+// of the peer, which may be used by the server to evaluate the request.
 func (d *DialListener) Listen(network, address string) (net.Listener, error) {
-	ln, err := net.Listen(network, address)
+	conn, bindAddr, err := d.dialContext(context.Background(), network, address)
 	if err != nil {
 		return nil, err
 	}
 	return &listner{
-		Listener: ln,
-		dialer:   d,
+		conn:   conn,
+		addr:   newAddr(bindAddr.String(), network),
+		dialer: d,
 	}, nil
 }
@@ -50,6 +50,13 @@ func (d *DialListener) Dial(network, address string) (*Conn, error) {
 }
 
 func (d *DialListener) DialContext(ctx context.Context, network, address string) (*Conn, error) {
+	conn, _, err := d.dialContext(ctx, network, address)
+	return conn, err
+}
+
+// dialContext is like DialContext, but also returns the address in the
+// reply from the server.
+func (d *DialListener) dialContext(ctx context.Context, network, address string) (*Conn, *address.Info, error) {
 	if len(d.AuthMethods) == 0 {
 		d.AuthMethods = map[auth.Method]auth.Authenticator{
 			auth.MethodNotRequired: &NotRequired{},
@@ -58,11 +65,18 @@ func (d *DialListener) DialContext(ctx context.Context, network, address string)
 
 	socks5Conn, err := d.Dialer.DialContext(ctx, d.network, d.address)
 	if err != nil {
-		return nil, d.newError(err, network, address)
+		return nil, nil, d.newError(err, network, address)
 	}
-	relayAddr, err := d.send(ctx, socks5Conn, address)
+	dstAddr := address
+	if d.cmd == socks5.CmdUDPAssociate {
+		// DST.ADDR and DST.PORT of UDP ASSOCIATE are the address which the
+		// client sends datagrams from. It is unknown until the UDP socket
+		// is dialed, so let the server use the address of this connection.
+		dstAddr = "0.0.0.0:0"
+	}
+	relayAddr, err := d.send(ctx, socks5Conn, dstAddr)
 	if err != nil {
-		return nil, d.newError(err, network, address)
+		return nil, nil, d.newError(err, network, address)
 	}
 
 	var udpConn net.Conn
@@ -71,16 +85,16 @@ func (d *DialListener) DialContext(ctx context.Context, network, address string)
 		address := relayAddr.String()
 		udpConn, err = d.Dialer.DialContext(ctx, network, address)
 		if err != nil {
-			return nil, d.newError(err, network, address)
+			return nil, nil, d.newError(err, network, address)
 		}
 	}
 	host, port, err := addrutil.SplitHostPort(address)
 	if err != nil {
-		return nil, d.newError(err, network, address)
+		return nil, nil, d.newError(err, network, address)
 	}
 	aTyp, ip, err := addrutil.GetAddressInfo(host)
 	if err != nil {
-		return nil, d.newError(err, network, address)
+		return nil, nil, d.newError(err, network, address)
 	}
 
 	return &Conn{
@@ -89,7 +103,7 @@ func (d *DialListener) DialContext(ctx context.Context, network, address string)
 		targetHost: ip,
 		targetPort: port,
 		aTyp:       aTyp,
-	}, nil
+	}, relayAddr, nil
 }
 
 func (d *DialListener) send(ctx context.Context, conn net.Conn, address string) (*address.Info, error) {
@@ -104,7 +118,7 @@ func (d *DialListener) send(ctx context.Context, conn net.Conn, address string)
 	}
 
 	b := make([]byte, 0, 6+len(host)) // the size here is just an estimate
-	if err := d.authenticate(conn, b); err != nil {
+	if err := d.authenticate(ctx, conn, b); err != nil {
 		return nil, err
 	}
 	return d.sendCommand(conn, b, host, port)
@@ -163,7 +177,7 @@ func (d *DialListener) readReply(c net.Conn, b []byte) (*address.Info, error) {
 	return addrutil.Read(c)
 }
 
-func (d *DialListener) authenticate(c net.Conn, bytes []byte) error {
+func (d *DialListener) authenticate(ctx context.Context, c net.Conn, bytes []byte) error {
 	methodNum := len(d.AuthMethods)
 	if methodNum > 255 {
 		return errors.New("too many authentication methods")
@@ -188,10 +202,10 @@ func (d *DialListener) authenticate(c net.Conn, bytes []byte) error {
 		return fmt.Errorf("unexpected protocol version %d", bytes[0])
 	}
 
-	return d.assignAuthMethod(c, auth.Method(bytes[1]))
+	return d.assignAuthMethod(ctx, c, auth.Method(bytes[1]))
 }
 
-func (d *DialListener) assignAuthMethod(c net.Conn, method auth.Method) error {
+func (d *DialListener) assignAuthMethod(ctx context.Context, c net.Conn, method auth.Method) error {
 	if method == auth.MethodNoAcceptableMethods {
 		return errors.New("no acceptable authentication methods")
 	}
@@ -200,7 +214,8 @@ func (d *DialListener) assignAuthMethod(c net.Conn, method auth.Method) error {
 	if !ok {
 		return auth.ErrUnSupportedMethod
 	}
-	return authenticator.Authenticate(c)
+	_, err := authenticator.Authenticate(ctx, c)
+	return err
 }
 
 func (d *DialListener) newError(err error, network, address string) error {
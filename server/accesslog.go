@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/address"
+)
+
+// AccessRecord describes a completed request for Config.AccessLog.
+type AccessRecord struct {
+	// ConnID is the ID of the connection, which ConnIDFromContext returns.
+	ConnID uint64
+
+	// RemoteAddr is the address of the client.
+	RemoteAddr net.Addr
+
+	// User is the authenticated user, or empty if the client has not been
+	// identified.
+	User string
+
+	Command  socks5.Command
+	DestAddr *address.Info
+
+	// Reply is the status replied to the request.
+	Reply socks5.Reply
+
+	// BytesSent is the number of bytes relayed from the client to the
+	// destination, and BytesReceived is the other way around. For UDP
+	// ASSOCIATE, they count the payload of datagrams.
+	BytesSent, BytesReceived int64
+
+	// Start is the time when the request has been read and Duration is
+	// how long it took until completion.
+	Start    time.Time
+	Duration time.Duration
+
+	// AuthDuration is the time spent in method negotiation and
+	// authentication, ResolveDuration in resolving DST.ADDR by the server
+	// and DialDuration in dialing destinations. For UDP ASSOCIATE, they
+	// are summed up over datagrams.
+	AuthDuration    time.Duration
+	ResolveDuration time.Duration
+	DialDuration    time.Duration
+}
+
+// timing records the time spent in each phase of a request for AccessRecord.
+type timing struct {
+	auth, resolve, dial time.Duration
+}
+
+// traffic counts bytes relayed for a request. It is accessed atomically.
+type traffic struct {
+	sent, received int64
+}
+
+func (t *traffic) addSent(n int64) {
+	atomic.AddInt64(&t.sent, n)
+}
+
+func (t *traffic) addReceived(n int64) {
+	atomic.AddInt64(&t.received, n)
+}
+
+// reportTransfer calls Config.OnTransfer when the relay has finished.
+func (r *Request) reportTransfer() {
+	if onTransfer := r.server.config.OnTransfer; onTransfer != nil {
+		onTransfer(atomic.LoadInt64(&r.traffic.sent), atomic.LoadInt64(&r.traffic.received))
+	}
+}
+
+func (r *Request) logAccess(ctx context.Context, status socks5.Reply, start time.Time) {
+	accessLog := r.server.config.AccessLog
+	if accessLog == nil {
+		return
+	}
+	user, _ := UserFromContext(ctx)
+	connID, _ := ConnIDFromContext(ctx)
+	rec := &AccessRecord{
+		ConnID:        connID,
+		User:          user,
+		Command:       r.Command,
+		DestAddr:      r.DestAddr,
+		Reply:         status,
+		BytesSent:     atomic.LoadInt64(&r.traffic.sent),
+		BytesReceived: atomic.LoadInt64(&r.traffic.received),
+		Start:         start,
+		Duration:      time.Since(start),
+
+		AuthDuration:    r.timing.auth,
+		ResolveDuration: r.timing.resolve,
+		DialDuration:    r.timing.dial,
+	}
+	if r.conn != nil {
+		rec.RemoteAddr = r.conn.RemoteAddr()
+	}
+	accessLog(rec)
+}
+
+// jsonAccessRecord is the schema of records written by NewJSONAccessLog.
+type jsonAccessRecord struct {
+	Time          string  `json:"time"`
+	ConnID        uint64  `json:"conn_id"`
+	RemoteAddr    string  `json:"remote_addr,omitempty"`
+	User          string  `json:"user,omitempty"`
+	Command       string  `json:"command"`
+	Destination   string  `json:"destination,omitempty"`
+	Reply         int     `json:"reply"`
+	BytesSent     int64   `json:"bytes_sent"`
+	BytesReceived int64   `json:"bytes_received"`
+	DurationMs    float64 `json:"duration_ms"`
+}
+
+// NewJSONAccessLog returns a function for Config.AccessLog which writes each
+// record to w as a line of JSON such as:
+//
+//	{"time":"2019-10-24T09:00:00Z","conn_id":1,"remote_addr":"192.0.2.1:50000","user":"alice","command":"connect","destination":"example.com:443","reply":0,"bytes_sent":517,"bytes_received":4242,"duration_ms":1520.3}
+//
+// Writes are serialized so that it can be called concurrently. Write errors
+// are ignored.
+func NewJSONAccessLog(w io.Writer) func(rec *AccessRecord) {
+	var mu sync.Mutex
+	return func(rec *AccessRecord) {
+		jr := &jsonAccessRecord{
+			Time:          rec.Start.UTC().Format(time.RFC3339Nano),
+			ConnID:        rec.ConnID,
+			User:          rec.User,
+			Command:       strings.TrimPrefix(rec.Command.String(), "socks "),
+			Reply:         int(rec.Reply),
+			BytesSent:     rec.BytesSent,
+			BytesReceived: rec.BytesReceived,
+			DurationMs:    float64(rec.Duration) / float64(time.Millisecond),
+		}
+		if rec.RemoteAddr != nil {
+			jr.RemoteAddr = rec.RemoteAddr.String()
+		}
+		if rec.DestAddr != nil {
+			jr.Destination = rec.DestAddr.String()
+		}
+		b, err := json.Marshal(jr)
+		if err != nil {
+			return
+		}
+		b = append(b, '\n')
+
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write(b)
+	}
+}
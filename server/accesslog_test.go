@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/address"
+)
+
+func TestNewJSONAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	accessLog := NewJSONAccessLog(&buf)
+	rec := &AccessRecord{
+		ConnID:     7,
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000},
+		User:       "alice",
+		Command:    socks5.CmdConnect,
+		DestAddr: &address.Info{
+			Type: address.TypeFQDN,
+			Host: []byte("example.com"),
+			Port: 443,
+		},
+		Reply:         socks5.StatusSucceeded,
+		BytesSent:     10,
+		BytesReceived: 20,
+		Start:         time.Date(2019, 10, 24, 9, 0, 0, 0, time.UTC),
+		Duration:      1500 * time.Millisecond,
+	}
+	accessLog(rec)
+	accessLog(rec)
+
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("want 2 lines, but got %q", buf.String())
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(lines[0], &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"time":           "2019-10-24T09:00:00Z",
+		"conn_id":        float64(7),
+		"remote_addr":    "192.0.2.1:50000",
+		"user":           "alice",
+		"command":        "connect",
+		"destination":    "example.com:443",
+		"reply":          float64(0),
+		"bytes_sent":     float64(10),
+		"bytes_received": float64(20),
+		"duration_ms":    float64(1500),
+	}
+	if len(got) != len(want) {
+		t.Errorf("want fields %v, but got %v", want, got)
+	}
+	for key, w := range want {
+		if got[key] != w {
+			t.Errorf("%s: want %v, but got %v", key, w, got[key])
+		}
+	}
+}
@@ -1,63 +1,286 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"sort"
 
 	"github.com/Code-Hex/socks5"
 	"github.com/Code-Hex/socks5/auth"
 )
 
+// ErrNoAuthMethods returns when the client has offered no authentication methods.
+var ErrNoAuthMethods = errors.New("no authentication methods offered")
+
 var _ auth.Authenticator = (*NotRequired)(nil)
 
 type NotRequired struct{}
 
-func (n *NotRequired) Authenticate(conn io.ReadWriter) error {
-	_, err := conn.Write([]byte{
-		socks5.Version,
-		byte(auth.MethodNotRequired),
-	})
-	return err
+func (n *NotRequired) Authenticate(ctx context.Context, conn net.Conn) (*auth.Result, error) {
+	// nothing to do
+	return nil, nil
+}
+
+var _ auth.Authenticator = (*UsernamePassword)(nil)
+
+// UsernamePassword represents username/password authentication.
+// See: https://tools.ietf.org/html/rfc1929
+type UsernamePassword struct {
+	// Check reports whether the pair of username and password is valid.
+	Check func(username, password string) bool
+}
+
+// status of username/password subnegotiation.
+const (
+	userPassStatusSuccess = 0x00
+	userPassStatusFailure = 0x01
+)
+
+// Authenticate performs username/password subnegotiation.
+//
+// +----+------+----------+------+----------+
+// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+// +----+------+----------+------+----------+
+// | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+// +----+------+----------+------+----------+
+func (u *UsernamePassword) Authenticate(ctx context.Context, conn net.Conn) (*auth.Result, error) {
+	username, password, err := readUsernamePassword(conn)
+	if err != nil {
+		return nil, err
+	}
+	if u.Check == nil || !u.Check(username, password) {
+		result := &auth.Result{User: username}
+		if err := writeUsernamePasswordStatus(conn, userPassStatusFailure); err != nil {
+			return result, err
+		}
+		return result, auth.ErrAuthenticationFailed
+	}
+	if err := writeUsernamePasswordStatus(conn, userPassStatusSuccess); err != nil {
+		return nil, err
+	}
+	return &auth.Result{User: username}, nil
 }
 
-func (s *Socks5) authenticate(conn net.Conn) error {
-	// Read the version byte
+func readUsernamePassword(r io.Reader) (string, string, error) {
 	header := make([]byte, 2)
-	if _, err := conn.Read(header); err != nil {
-		return fmt.Errorf("failed to get authenticate information: %v", err)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", "", fmt.Errorf("failed to get username/password header: %v", err)
+	}
+	if header[0] != auth.UsernamePasswordVersion {
+		return "", "", fmt.Errorf("unsupported username/password version: %d", header[0])
+	}
+
+	username := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(r, username); err != nil {
+		return "", "", fmt.Errorf("failed to get username: %v", err)
+	}
+
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(r, plen); err != nil {
+		return "", "", fmt.Errorf("failed to get password length: %v", err)
+	}
+	password := make([]byte, int(plen[0]))
+	if _, err := io.ReadFull(r, password); err != nil {
+		return "", "", fmt.Errorf("failed to get password: %v", err)
+	}
+	return string(username), string(password), nil
+}
+
+// writeUsernamePasswordStatus writes the reply of username/password subnegotiation.
+//
+// +----+--------+
+// |VER | STATUS |
+// +----+--------+
+// | 1  |   1    |
+// +----+--------+
+func writeUsernamePasswordStatus(w io.Writer, status byte) error {
+	_, err := w.Write([]byte{auth.UsernamePasswordVersion, status})
+	return err
+}
+
+func (s *Socks5) authenticate(ctx context.Context, conn net.Conn) (*auth.Result, error) {
+	method, result, err := s.negotiate(ctx, conn)
+	if s.config.OnAuth != nil {
+		var user string
+		if result != nil {
+			user = result.User
+		}
+		s.config.OnAuth(conn.RemoteAddr(), method, user, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// negotiate selects the authentication method and runs it. The returned
+// method is auth.MethodNoAcceptableMethods if no method has been selected.
+func (s *Socks5) negotiate(ctx context.Context, conn net.Conn) (auth.Method, *auth.Result, error) {
+	certUser, err := s.clientCertUser(conn)
+	if err != nil {
+		return auth.MethodNoAcceptableMethods, nil, err
+	}
+
+	// +----+----------+----------+
+	// |VER | NMETHODS | METHODS  |
+	// +----+----------+----------+
+	// | 1  |    1     | 1 to 255 |
+	// +----+----------+----------+
+	header := make([]byte, 1)
+
+	// Read the version byte before anything else so that other protocols
+	// such as SOCKS4 are not misinterpreted as a method list.
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return auth.MethodNoAcceptableMethods, nil, fmt.Errorf("failed to get authenticate information: %v", err)
 	}
 
 	// Ensure we are compatible
 	if header[0] != socks5.Version {
-		return fmt.Errorf("unsupported version: %d", header[0])
+		return auth.MethodNoAcceptableMethods, nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header[0])
 	}
 
-	numMethods := int(header[1])
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return auth.MethodNoAcceptableMethods, nil, fmt.Errorf("failed to get authenticate information: %v", err)
+	}
+	numMethods := int(header[0])
+	if numMethods == 0 {
+		return auth.MethodNoAcceptableMethods, nil, ErrNoAuthMethods
+	}
 	methods := make([]byte, numMethods)
-	if _, err := io.ReadAtLeast(conn, methods, numMethods); err != nil {
-		return err
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return auth.MethodNoAcceptableMethods, nil, fmt.Errorf("failed to get authentication methods: %v", err)
 	}
 
-	authenticator, err := s.methodAssign(methods)
+	if certUser != "" && bytes.IndexByte(methods, byte(auth.MethodNotRequired)) >= 0 {
+		// The client certificate has already authenticated the client.
+		if _, err := conn.Write([]byte{socks5.Version, byte(auth.MethodNotRequired)}); err != nil {
+			return auth.MethodNotRequired, nil, err
+		}
+		return auth.MethodNotRequired, &auth.Result{User: certUser}, nil
+	}
+
+	method, authenticator, err := s.methodAssign(conn, methods)
 	if err != nil {
+		// Tell the client that none of the methods are acceptable
+		// so that it can report it instead of a connection reset.
+		// See: Page 3 in https://tools.ietf.org/html/rfc1928
 		_, e := conn.Write([]byte{
 			socks5.Version,
 			byte(auth.MethodNoAcceptableMethods),
 		})
-		log.Println(e)
-		return err
+		if e != nil {
+			return method, nil, fmt.Errorf("failed to reply no acceptable methods: %v", e)
+		}
+		return method, nil, err
+	}
+
+	// +----+--------+
+	// |VER | METHOD |
+	// +----+--------+
+	// | 1  |   1    |
+	// +----+--------+
+	if _, err := conn.Write([]byte{socks5.Version, byte(method)}); err != nil {
+		return method, nil, err
 	}
-	return authenticator.Authenticate(conn)
+	result, err := authenticator.Authenticate(ctx, conn)
+	return method, result, err
 }
 
-func (s *Socks5) methodAssign(methods []byte) (auth.Authenticator, error) {
+// clientCertUser returns the user mapped from the TLS client certificate.
+// It returns empty string if the client has not been identified.
+func (s *Socks5) clientCertUser(conn net.Conn) (string, error) {
+	if dc, ok := conn.(*debugConn); ok {
+		conn = dc.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || s.config.ClientCertMapper == nil {
+		return "", nil
+	}
+	// Complete the handshake to get the peer certificates.
+	if err := tlsConn.Handshake(); err != nil {
+		return "", fmt.Errorf("tls handshake error: %v", err)
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", nil
+	}
+	user, ok := s.config.ClientCertMapper(certs[0])
+	if !ok {
+		return "", nil
+	}
+	return user, nil
+}
+
+// methodAssign selects exactly one method from those offered by the client.
+func (s *Socks5) methodAssign(conn net.Conn, methods []byte) (auth.Method, auth.Authenticator, error) {
+	candidates := s.candidateMethods(methods)
+	if len(candidates) == 0 {
+		return auth.MethodNoAcceptableMethods, nil, auth.ErrUnSupportedMethod
+	}
+	method := candidates[0]
+	if s.config.SelectMethod != nil {
+		selected, ok := s.config.SelectMethod(conn, candidates)
+		if !ok || !containsMethod(candidates, selected) {
+			return auth.MethodNoAcceptableMethods, nil, auth.ErrUnSupportedMethod
+		}
+		method = selected
+	}
+	return method, s.config.AuthMethods[method], nil
+}
+
+// candidateMethods returns methods supported by both the client and the
+// server in order of preference.
+func (s *Socks5) candidateMethods(methods []byte) []auth.Method {
+	offered := make(map[auth.Method]bool, len(methods))
 	for _, b := range methods {
-		method := auth.Method(b) // type cast
-		if authenticator, ok := s.config.AuthMethods[method]; ok {
-			return authenticator, nil
+		offered[auth.Method(b)] = true // type cast
+	}
+	var candidates []auth.Method
+	for _, method := range s.methodPreference() {
+		if method == auth.MethodNotRequired && s.config.RequireAuth {
+			continue
+		}
+		if !offered[method] {
+			continue
+		}
+		if _, ok := s.config.AuthMethods[method]; ok {
+			candidates = append(candidates, method)
 		}
 	}
-	return nil, auth.ErrUnSupportedMethod
+	return candidates
+}
+
+func containsMethod(methods []auth.Method, method auth.Method) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Socks5) methodPreference() []auth.Method {
+	if len(s.config.MethodPreference) > 0 {
+		return s.config.MethodPreference
+	}
+	methods := make([]auth.Method, 0, len(s.config.AuthMethods))
+	for method := range s.config.AuthMethods {
+		methods = append(methods, method)
+	}
+	sort.Slice(methods, func(i, j int) bool {
+		// no authentication is the weakest.
+		if methods[j] == auth.MethodNotRequired {
+			return methods[i] != auth.MethodNotRequired
+		}
+		if methods[i] == auth.MethodNotRequired {
+			return false
+		}
+		return methods[i] < methods[j]
+	})
+	return methods
 }
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/auth"
+)
+
+func TestMethodAssign_RequireAuth(t *testing.T) {
+	s := New(&Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodNotRequired:      &NotRequired{},
+			auth.MethodUsernamePassword: &UsernamePassword{},
+		},
+		RequireAuth: true,
+	})
+
+	if _, _, err := s.methodAssign(nil, []byte{byte(auth.MethodNotRequired)}); err != auth.ErrUnSupportedMethod {
+		t.Fatalf("want %v, but got %v", auth.ErrUnSupportedMethod, err)
+	}
+
+	offered := []byte{byte(auth.MethodNotRequired), byte(auth.MethodUsernamePassword)}
+	method, _, err := s.methodAssign(nil, offered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != auth.MethodUsernamePassword {
+		t.Fatalf("want %d, but got %d", auth.MethodUsernamePassword, method)
+	}
+}
+
+func TestMethodAssign_Preference(t *testing.T) {
+	methods := map[auth.Method]auth.Authenticator{
+		auth.MethodNotRequired:      &NotRequired{},
+		auth.MethodGSSAPI:           &GSSAPI{},
+		auth.MethodUsernamePassword: &UsernamePassword{},
+	}
+	all := []byte{
+		byte(auth.MethodNotRequired),
+		byte(auth.MethodUsernamePassword),
+		byte(auth.MethodGSSAPI),
+	}
+	cases := []struct {
+		name       string
+		preference []auth.Method
+		offered    []byte
+		want       auth.Method
+	}{
+		{
+			name:    "default prefers GSSAPI",
+			offered: all,
+			want:    auth.MethodGSSAPI,
+		},
+		{
+			name:    "default prefers username/password over no auth",
+			offered: []byte{byte(auth.MethodNotRequired), byte(auth.MethodUsernamePassword)},
+			want:    auth.MethodUsernamePassword,
+		},
+		{
+			name:       "configured preference",
+			preference: []auth.Method{auth.MethodUsernamePassword, auth.MethodGSSAPI},
+			offered:    all,
+			want:       auth.MethodUsernamePassword,
+		},
+		{
+			name:       "configured preference not offered",
+			preference: []auth.Method{0x80, auth.MethodNotRequired},
+			offered:    all,
+			want:       auth.MethodNotRequired,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(&Config{
+				AuthMethods:      methods,
+				MethodPreference: tc.preference,
+			})
+			got, _, err := s.methodAssign(nil, tc.offered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %d, but got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestAuthenticate_UnsupportedVersion(t *testing.T) {
+	s := New(nil)
+	client, conn := net.Pipe()
+	defer client.Close()
+	go func() {
+		// SOCKS4 CONNECT to 127.0.0.1:80
+		client.Write([]byte{0x04, 0x01, 0x00, 0x50, 127, 0, 0, 1, 0})
+	}()
+
+	_, err := s.authenticate(context.Background(), conn)
+	conn.Close()
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("want %v, but got %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func TestAuthenticate_NoMethods(t *testing.T) {
+	s := New(nil)
+	client, conn := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte{socks5.Version, 0})
+
+	_, err := s.authenticate(context.Background(), conn)
+	conn.Close()
+	if err != ErrNoAuthMethods {
+		t.Fatalf("want %v, but got %v", ErrNoAuthMethods, err)
+	}
+}
+
+func TestMethodAssign_SelectMethod(t *testing.T) {
+	trusted := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	untrusted := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}
+
+	// prefer no authentication from trusted clients, otherwise fall back
+	// to the strongest method except no authentication.
+	policy := func(conn net.Conn, candidates []auth.Method) (auth.Method, bool) {
+		if conn.RemoteAddr().(*net.TCPAddr).IP.IsLoopback() {
+			return auth.MethodNotRequired, true
+		}
+		for _, method := range candidates {
+			if method != auth.MethodNotRequired {
+				return method, true
+			}
+		}
+		return 0, false
+	}
+	s := New(&Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodNotRequired:      &NotRequired{},
+			auth.MethodGSSAPI:           &GSSAPI{},
+			auth.MethodUsernamePassword: &UsernamePassword{},
+		},
+		SelectMethod: policy,
+	})
+
+	cases := []struct {
+		name    string
+		remote  net.Addr
+		offered []auth.Method
+		want    auth.Method
+		wantErr bool
+	}{
+		{
+			name:    "trusted client",
+			remote:  trusted,
+			offered: []auth.Method{auth.MethodUsernamePassword, auth.MethodNotRequired},
+			want:    auth.MethodNotRequired,
+		},
+		{
+			name:    "trusted client without no authentication",
+			remote:  trusted,
+			offered: []auth.Method{auth.MethodUsernamePassword},
+			wantErr: true,
+		},
+		{
+			name:    "untrusted client prefers GSSAPI",
+			remote:  untrusted,
+			offered: []auth.Method{auth.MethodNotRequired, auth.MethodUsernamePassword, auth.MethodGSSAPI},
+			want:    auth.MethodGSSAPI,
+		},
+		{
+			name:    "untrusted client falls back to username/password",
+			remote:  untrusted,
+			offered: []auth.Method{auth.MethodNotRequired, auth.MethodUsernamePassword},
+			want:    auth.MethodUsernamePassword,
+		},
+		{
+			name:    "untrusted client with no authentication only",
+			remote:  untrusted,
+			offered: []auth.Method{auth.MethodNotRequired},
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			offered := make([]byte, len(tc.offered))
+			for i, method := range tc.offered {
+				offered[i] = byte(method)
+			}
+			got, _, err := s.methodAssign(&addrConn{remote: tc.remote}, offered)
+			if tc.wantErr {
+				if err != auth.ErrUnSupportedMethod {
+					t.Fatalf("want %v, but got %v", auth.ErrUnSupportedMethod, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %d, but got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
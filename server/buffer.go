@@ -0,0 +1,30 @@
+package server
+
+import (
+	"io"
+	"sync"
+)
+
+// bufferPool reuses relay buffers among connections so that each of them
+// does not allocate its own.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, size)
+				return &b
+			},
+		},
+	}
+}
+
+// copy is like io.Copy, but uses a buffer of the pool if it is needed.
+func (p *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	b := p.pool.Get().(*[]byte)
+	defer p.pool.Put(b)
+	return io.CopyBuffer(dst, src, *b)
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// readerOnly and writerOnly hide io.WriterTo and io.ReaderFrom so that the
+// copy goes through the buffer.
+type readerOnly struct{ io.Reader }
+type writerOnly struct{ io.Writer }
+
+func TestBufferPool_Copy(t *testing.T) {
+	data := make([]byte, 1<<20+123)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{defaultBufferSize, 7} {
+		p := newBufferPool(size)
+		// the second copy reuses the buffer of the first one.
+		for i := 0; i < 2; i++ {
+			var dst bytes.Buffer
+			n, err := p.copy(writerOnly{&dst}, readerOnly{bytes.NewReader(data)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(len(data)) || !bytes.Equal(dst.Bytes(), data) {
+				t.Fatalf("size %d, copy %d: data is corrupted (%d bytes copied)", size, i, n)
+			}
+		}
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	data := make([]byte, 64*1024)
+	b.Run("io.Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			io.Copy(writerOnly{ioutil.Discard}, readerOnly{bytes.NewReader(data)})
+		}
+	})
+	b.Run("bufferPool", func(b *testing.B) {
+		p := newBufferPool(defaultBufferSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p.copy(writerOnly{ioutil.Discard}, readerOnly{bytes.NewReader(data)})
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// errByteLimit is returned by byteLimitReader when the relay has
+// transferred Config.MaxBytesPerConn bytes.
+var errByteLimit = errors.New("socks5: relay reached the byte limit")
+
+// byteLimit is the number of bytes which both directions of a relay may
+// still transfer.
+type byteLimit struct {
+	remaining int64 // accessed atomically
+}
+
+// take takes up to n bytes from the limit and returns the number taken.
+func (l *byteLimit) take(n int) int {
+	for {
+		remaining := atomic.LoadInt64(&l.remaining)
+		m := int64(n)
+		if m > remaining {
+			m = remaining
+		}
+		if atomic.CompareAndSwapInt64(&l.remaining, remaining, remaining-m) {
+			return int(m)
+		}
+	}
+}
+
+// byteLimitReader returns no more than the remaining bytes of limit. The
+// bytes are taken after reading so that a read blocked in one direction
+// does not hold the limit of the other.
+type byteLimitReader struct {
+	r     io.Reader
+	limit *byteLimit
+}
+
+func (r *byteLimitReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt64(&r.limit.remaining) <= 0 {
+		return 0, errByteLimit
+	}
+	n, err := r.r.Read(p)
+	if m := r.limit.take(n); m < n {
+		// the rest is discarded since the relay is closed.
+		return m, errByteLimit
+	}
+	return n, err
+}
@@ -0,0 +1,38 @@
+package server
+
+import "context"
+
+// contextKey is a value for use with context.WithValue.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string { return "socks5 context value " + k.name }
+
+// userContextKey is a context key for the authenticated user.
+var userContextKey = &contextKey{"user"}
+
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// UserFromContext returns the user authenticated on the connection which
+// ctx belongs to. It reports false if the client has not been identified.
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userContextKey).(string)
+	return user, ok
+}
+
+// connIDContextKey is a context key for the ID of the connection.
+var connIDContextKey = &contextKey{"conn-id"}
+
+func withConnID(ctx context.Context, id uint64) context.Context {
+	return context.WithValue(ctx, connIDContextKey, id)
+}
+
+// ConnIDFromContext returns the ID of the connection which ctx belongs to.
+// IDs are unique among the connections accepted by a server.
+func ConnIDFromContext(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(connIDContextKey).(uint64)
+	return id, ok
+}
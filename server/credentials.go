@@ -0,0 +1,170 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// StaticCredentials is an in-memory credential store for username/password
+// authentication. It is safe for concurrent use, so users can be added or
+// removed while the server is running.
+//
+// The Check method can be used as UsernamePassword.Check.
+type StaticCredentials struct {
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+// NewStaticCredentials returns credential store seeded with the given
+// pairs of username and password.
+func NewStaticCredentials(users map[string]string) *StaticCredentials {
+	c := &StaticCredentials{
+		users: make(map[string]string, len(users)),
+	}
+	for user, pass := range users {
+		c.users[user] = pass
+	}
+	return c
+}
+
+// Add adds the user or replaces the password of the user.
+func (c *StaticCredentials) Add(user, pass string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.users == nil {
+		c.users = make(map[string]string)
+	}
+	c.users[user] = pass
+}
+
+// Remove removes the user.
+func (c *StaticCredentials) Remove(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.users, user)
+}
+
+// Check reports whether the pair of user and pass is registered.
+//
+// The password is compared in constant time regardless of the contents
+// and lengths, and that of an unknown user is compared against a dummy
+// one, so the time taken does not reveal passwords or existing users.
+func (c *StaticCredentials) Check(user, pass string) bool {
+	c.mu.RLock()
+	wantPass, ok := c.users[user]
+	c.mu.RUnlock()
+
+	if !ok {
+		wantPass = ""
+	}
+	// Compare digests because subtle.ConstantTimeCompare returns
+	// immediately if the lengths differ.
+	match := subtle.ConstantTimeCompare(digest(pass), digest(wantPass))
+	return ok && match == 1
+}
+
+func digest(s string) []byte {
+	sum := sha256.Sum256([]byte(s))
+	return sum[:]
+}
+
+// HashedCredentials is an in-memory credential store which keeps bcrypt
+// hashes instead of plaintext passwords. It is safe for concurrent use.
+//
+// The Check method can be used as UsernamePassword.Check.
+type HashedCredentials struct {
+	mu    sync.RWMutex
+	users map[string][]byte
+
+	// dummy is compared against for unknown users so that the time
+	// taken by Check does not reveal which users exist. Its cost is the
+	// maximum of the hashes added.
+	dummy []byte
+}
+
+// NewHashedCredentials returns an empty hashed credential store.
+func NewHashedCredentials() *HashedCredentials {
+	return &HashedCredentials{
+		users: make(map[string][]byte),
+	}
+}
+
+// HashPassword returns the bcrypt hash of pass at the given cost.
+// If cost is less than bcrypt.MinCost, bcrypt.DefaultCost is used.
+func HashPassword(pass string, cost int) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(pass), cost)
+}
+
+// AddHashed adds the user with bcrypt hash or replaces the hash of the user.
+func (c *HashedCredentials) AddHashed(user string, bcryptHash []byte) error {
+	cost, err := bcrypt.Cost(bcryptHash)
+	if err != nil {
+		return err
+	}
+	if err := c.raiseDummyCost(cost); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.users == nil {
+		c.users = make(map[string][]byte)
+	}
+	c.users[user] = bcryptHash
+	return nil
+}
+
+// raiseDummyCost regenerates the dummy hash if its cost is less than cost.
+// The hash is generated without the lock, which would block Check.
+func (c *HashedCredentials) raiseDummyCost(cost int) error {
+	c.mu.RLock()
+	dummy := c.dummy
+	c.mu.RUnlock()
+	if dummy != nil && dummyCost(dummy) >= cost {
+		return nil
+	}
+
+	dummy, err := bcrypt.GenerateFromPassword([]byte("dummy password"), cost)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// another AddHashed may have raised it meanwhile.
+	if c.dummy == nil || dummyCost(c.dummy) < cost {
+		c.dummy = dummy
+	}
+	return nil
+}
+
+// Remove removes the user.
+func (c *HashedCredentials) Remove(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.users, user)
+}
+
+// Check reports whether pass matches the hash registered for user.
+func (c *HashedCredentials) Check(user, pass string) bool {
+	c.mu.RLock()
+	hash, ok := c.users[user]
+	dummy := c.dummy
+	c.mu.RUnlock()
+
+	if !ok {
+		if dummy != nil {
+			// An unknown user still pays for one comparison.
+			bcrypt.CompareHashAndPassword(dummy, []byte(pass))
+		}
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(pass)) == nil
+}
+
+func dummyCost(hash []byte) int {
+	cost, _ := bcrypt.Cost(hash)
+	return cost
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestStaticCredentials(t *testing.T) {
+	c := NewStaticCredentials(map[string]string{
+		"user": "pass",
+	})
+	if !c.Check("user", "pass") {
+		t.Fatal("expected seeded user to be valid")
+	}
+	if c.Check("user", "wrong") {
+		t.Fatal("expected wrong password to be invalid")
+	}
+	if c.Check("unknown", "pass") {
+		t.Fatal("expected unknown user to be invalid")
+	}
+	if c.Check("unknown", "") {
+		t.Fatal("expected unknown user with empty password to be invalid")
+	}
+
+	c.Add("user2", "pass2")
+	if !c.Check("user2", "pass2") {
+		t.Fatal("expected added user to be valid")
+	}
+	c.Remove("user")
+	if c.Check("user", "pass") {
+		t.Fatal("expected removed user to be invalid")
+	}
+}
+
+func BenchmarkStaticCredentials_Check(b *testing.B) {
+	c := NewStaticCredentials(map[string]string{
+		"user": "correct horse battery staple",
+	})
+	// Each case should take about the same time per operation.
+	cases := []struct {
+		name string
+		user string
+		pass string
+	}{
+		{name: "valid", user: "user", pass: "correct horse battery staple"},
+		{name: "wrong prefix", user: "user", pass: "xorrect horse battery staple"},
+		{name: "wrong suffix", user: "user", pass: "correct horse battery staplex"},
+		{name: "short password", user: "user", pass: "c"},
+		{name: "unknown user", user: "unknown", pass: "correct horse battery staple"},
+	}
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c.Check(tc.user, tc.pass)
+			}
+		})
+	}
+}
+
+func TestStaticCredentials_Concurrent(t *testing.T) {
+	c := NewStaticCredentials(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		user := "user" + strconv.Itoa(i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Add(user, "pass")
+				c.Remove(user)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Check(user, "pass")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHashedCredentials(t *testing.T) {
+	hash, err := HashPassword("pass", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewHashedCredentials()
+	if c.Check("user", "pass") {
+		t.Fatal("expected empty store to reject")
+	}
+	if err := c.AddHashed("user", hash); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddHashed("broken", []byte("pass")); err == nil {
+		t.Fatal("expected error for non-bcrypt hash")
+	}
+	if !c.Check("user", "pass") {
+		t.Fatal("expected user to be valid")
+	}
+	if c.Check("user", "wrong") {
+		t.Fatal("expected wrong password to be invalid")
+	}
+	if c.Check("unknown", "pass") {
+		t.Fatal("expected unknown user to be invalid")
+	}
+}
+
+func TestHashedCredentials_DummyCost(t *testing.T) {
+	c := NewHashedCredentials()
+	for _, cost := range []int{bcrypt.MinCost + 1, bcrypt.MinCost} {
+		hash, err := HashPassword("pass", cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.AddHashed("user"+strconv.Itoa(cost), hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// unknown users take as long as the most costly user.
+	if got, want := dummyCost(c.dummy), bcrypt.MinCost+1; got != want {
+		t.Fatalf("want dummy cost %d, but got %d", want, got)
+	}
+}
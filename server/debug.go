@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// maxDebugDump is the maximum number of bytes dumped per read or write.
+const maxDebugDump = 256
+
+// debugConn logs the bytes read from and written to the client for
+// Config.Debug until the request starts relaying.
+type debugConn struct {
+	net.Conn
+	logger  Logger
+	id      uint64
+	stopped int32 // accessed atomically
+}
+
+func (c *debugConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.dump("read", b[:n])
+	return n, err
+}
+
+func (c *debugConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.dump("write", b[:n])
+	return n, err
+}
+
+// stop stops logging so that relayed payload is never logged.
+func (c *debugConn) stop() {
+	atomic.StoreInt32(&c.stopped, 1)
+}
+
+func (c *debugConn) dump(op string, b []byte) {
+	if len(b) == 0 || atomic.LoadInt32(&c.stopped) != 0 {
+		return
+	}
+	if len(b) > maxDebugDump {
+		c.logger.Debugf("socks5: conn %d %s: % x ... (%d bytes)", c.id, op, b[:maxDebugDump], len(b))
+		return
+	}
+	c.logger.Debugf("socks5: conn %d %s: % x", c.id, op, b)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDNSCacheSize = 1024
+
+	// maxDNSNegativeTTL is the longest time a failed lookup is cached.
+	maxDNSNegativeTTL = 5 * time.Second
+)
+
+// dnsCache is an LRU cache of lookup results for Config.DNSCacheTTL.
+type dnsCache struct {
+	ttl  time.Duration
+	size int
+	now  func() time.Time // for testing
+
+	mu      sync.Mutex
+	lru     *list.List // of *dnsEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type dnsEntry struct {
+	host    string
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration, size int) *dnsCache {
+	if size <= 0 {
+		size = defaultDNSCacheSize
+	}
+	return &dnsCache{
+		ttl:     ttl,
+		size:    size,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached result for host. The returned entry must not be
+// modified.
+func (c *dnsCache) get(host string) (*dnsEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[host]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*dnsEntry)
+	if !c.now().Before(e.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, host)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return e, true
+}
+
+// put caches the result of looking up host. Failures are cached for a
+// shorter time so that they are retried soon.
+func (c *dnsCache) put(host string, ips []net.IP, err error) {
+	ttl := c.ttl
+	if err != nil && ttl > maxDNSNegativeTTL {
+		ttl = maxDNSNegativeTTL
+	}
+	e := &dnsEntry{host: host, ips: ips, err: err, expires: c.now().Add(ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[host]; ok {
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[host] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsEntry).host)
+	}
+}
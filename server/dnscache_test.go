@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDNSCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newDNSCache(time.Minute, 2)
+	c.now = func() time.Time { return now }
+
+	ips := []net.IP{net.ParseIP("192.0.2.1")}
+	c.put("a.example", ips, nil)
+	if e, ok := c.get("a.example"); !ok || !e.ips[0].Equal(ips[0]) {
+		t.Fatalf("want cached %v, but got %v (%v)", ips, e, ok)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get("a.example"); ok {
+		t.Fatal("want expired entry")
+	}
+}
+
+func TestDNSCache_Negative(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newDNSCache(time.Hour, 0)
+	c.now = func() time.Time { return now }
+
+	c.put("missing.example", nil, errors.New("no such host"))
+	if e, ok := c.get("missing.example"); !ok || e.err == nil {
+		t.Fatalf("want cached failure, but got %v (%v)", e, ok)
+	}
+	now = now.Add(maxDNSNegativeTTL)
+	if _, ok := c.get("missing.example"); ok {
+		t.Fatal("want failure expired before the TTL")
+	}
+}
+
+func TestDNSCache_Evict(t *testing.T) {
+	c := newDNSCache(time.Minute, 2)
+	c.put("a.example", nil, nil)
+	c.put("b.example", nil, nil)
+	c.get("a.example") // b.example is now the least recently used
+	c.put("c.example", nil, nil)
+
+	for host, want := range map[string]bool{
+		"a.example": true,
+		"b.example": false,
+		"c.example": true,
+	} {
+		if _, ok := c.get(host); ok != want {
+			t.Errorf("%s: want cached %v, but got %v", host, want, ok)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/Code-Hex/socks5/auth"
+	"github.com/Code-Hex/socks5/gssapi"
+)
+
+var _ auth.Authenticator = (*GSSAPI)(nil)
+
+// GSSAPI represents GSS-API authentication.
+// See: https://tools.ietf.org/html/rfc1961
+type GSSAPI struct {
+	// Provider creates a security context for each client.
+	Provider gssapi.Provider
+}
+
+// Authenticate establishes the security context with the client and then
+// negotiates the protection level. The server always selects
+// gssapi.ProtectionNone, so the session is not encapsulated.
+func (g *GSSAPI) Authenticate(ctx context.Context, conn net.Conn) (*auth.Result, error) {
+	if g.Provider == nil {
+		gssapi.WriteAbort(conn)
+		return nil, errors.New("gssapi provider is not configured")
+	}
+	gssCtx, err := g.Provider.NewContext()
+	if err != nil {
+		gssapi.WriteAbort(conn)
+		return nil, err
+	}
+	if err := g.establish(conn, gssCtx); err != nil {
+		return nil, err
+	}
+	if err := g.negotiateProtection(conn, gssCtx); err != nil {
+		return nil, err
+	}
+	return &auth.Result{User: gssCtx.SourceName()}, nil
+}
+
+func (g *GSSAPI) establish(conn net.Conn, gssCtx gssapi.Context) error {
+	for {
+		mtyp, token, err := gssapi.ReadMessage(conn)
+		if err != nil {
+			return err
+		}
+		if mtyp != gssapi.MessageAuthentication {
+			gssapi.WriteAbort(conn)
+			return fmt.Errorf("unexpected gssapi message type: %d", mtyp)
+		}
+		out, established, err := gssCtx.Accept(token)
+		if err != nil {
+			gssapi.WriteAbort(conn)
+			return fmt.Errorf("%w: %v", auth.ErrAuthenticationFailed, err)
+		}
+		if len(out) > 0 || !established {
+			if err := gssapi.WriteMessage(conn, gssapi.MessageAuthentication, out); err != nil {
+				return err
+			}
+		}
+		if established {
+			return nil
+		}
+	}
+}
+
+func (g *GSSAPI) negotiateProtection(conn net.Conn, gssCtx gssapi.Context) error {
+	mtyp, token, err := gssapi.ReadMessage(conn)
+	if err != nil {
+		return err
+	}
+	if mtyp != gssapi.MessageProtection {
+		gssapi.WriteAbort(conn)
+		return fmt.Errorf("unexpected gssapi message type: %d", mtyp)
+	}
+	level, err := gssCtx.Unwrap(token)
+	if err != nil || len(level) != 1 {
+		gssapi.WriteAbort(conn)
+		return fmt.Errorf("invalid gssapi protection level message: %v", err)
+	}
+
+	selected, err := gssCtx.Wrap([]byte{byte(gssapi.ProtectionNone)}, false)
+	if err != nil {
+		gssapi.WriteAbort(conn)
+		return err
+	}
+	return gssapi.WriteMessage(conn, gssapi.MessageProtection, selected)
+}
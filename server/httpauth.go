@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Code-Hex/socks5/auth"
+)
+
+var _ auth.Authenticator = (*HTTPAuthenticator)(nil)
+
+// HTTPAuthenticator represents username/password authentication which
+// validates credentials through an external HTTP endpoint.
+//
+// The credentials are sent as a JSON object such as
+// {"username":"user","password":"pass"} by POST request, and any 2xx
+// response is treated as success. The endpoint should be HTTPS because
+// the request contains the password.
+type HTTPAuthenticator struct {
+	// URL is the endpoint to validate credentials.
+	URL string
+
+	// Timeout is the maximum duration for a request. Zero means no timeout.
+	Timeout time.Duration
+
+	// Header is sent with every request, e.g. to authorize the proxy.
+	Header http.Header
+
+	// Client is used to send requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+type httpAuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Authenticate performs username/password subnegotiation and asks the
+// endpoint whether the credentials are valid. The request is canceled when
+// ctx is done, e.g. the server is shutting down.
+func (h *HTTPAuthenticator) Authenticate(ctx context.Context, conn net.Conn) (*auth.Result, error) {
+	username, password, err := readUsernamePassword(conn)
+	if err != nil {
+		return nil, err
+	}
+	result := &auth.Result{User: username}
+	if err := h.check(ctx, username, password); err != nil {
+		if werr := writeUsernamePasswordStatus(conn, userPassStatusFailure); werr != nil {
+			return result, werr
+		}
+		return result, err
+	}
+	if err := writeUsernamePasswordStatus(conn, userPassStatusSuccess); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (h *HTTPAuthenticator) check(ctx context.Context, username, password string) error {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	body, err := json.Marshal(&httpAuthRequest{
+		Username: username,
+		Password: password,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range h.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request authentication: %v", err)
+	}
+	defer resp.Body.Close()
+	// drain to reuse the connection.
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %s", auth.ErrAuthenticationFailed, resp.Status)
+	}
+	return nil
+}
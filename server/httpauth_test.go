@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Code-Hex/socks5/auth"
+)
+
+func TestHTTPAuthenticator(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req httpAuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Username != "user" || req.Password != "pass" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	h := &HTTPAuthenticator{
+		URL:    ts.URL,
+		Header: http.Header{"X-Token": []string{"secret"}},
+	}
+	ctx := context.Background()
+	if err := h.check(ctx, "user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.check(ctx, "user", "wrong"); !errors.Is(err, auth.ErrAuthenticationFailed) {
+		t.Fatalf("want %v, but got %v", auth.ErrAuthenticationFailed, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := h.check(canceled, "user", "pass"); err == nil {
+		t.Fatal("expected error for canceled context")
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// errIdle is returned by idleReader when neither direction of the relay
+// has transferred data for Config.IdleTimeout.
+var errIdle = errors.New("socks5: relay is idle")
+
+// idleTimer tracks the last activity of a relay, which is shared by both
+// directions so that a connection transferring data in one direction only
+// is kept alive.
+type idleTimer struct {
+	timeout time.Duration
+	last    int64 // UnixNano; accessed atomically
+}
+
+func newIdleTimer(timeout time.Duration) *idleTimer {
+	return &idleTimer{timeout: timeout, last: time.Now().UnixNano()}
+}
+
+func (t *idleTimer) touch() {
+	atomic.StoreInt64(&t.last, time.Now().UnixNano())
+}
+
+func (t *idleTimer) deadline() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.last)).Add(t.timeout)
+}
+
+// idleReader reads from conn with read deadlines which are extended on
+// activity in either direction.
+type idleReader struct {
+	conn  net.Conn
+	timer *idleTimer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	for {
+		deadline := r.timer.deadline()
+		if !time.Now().Before(deadline) {
+			return 0, errIdle
+		}
+		r.conn.SetReadDeadline(deadline)
+		n, err := r.conn.Read(p)
+		if n > 0 {
+			r.timer.touch()
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && n == 0 {
+			// the other direction may have been active meanwhile.
+			continue
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// AuthFailureLimiter temporarily bans client IPs which repeatedly fail to
+// authenticate. A failure is an error from the authenticator which wraps
+// auth.ErrAuthenticationFailed. Successful authentication does not clear
+// failures, so that a client with one valid account cannot keep guessing
+// others; they expire only after Window. It is safe for concurrent use.
+type AuthFailureLimiter struct {
+	// MaxFailures is the number of failures within Window after which
+	// the IP is banned. If zero or negative, 5 is used.
+	MaxFailures int
+
+	// Window is the period in which failures are counted.
+	Window time.Duration
+
+	// BanDuration is how long the IP is refused after being banned.
+	BanDuration time.Duration
+
+	mu        sync.Mutex
+	clients   map[string]*authFailures
+	lastPrune time.Time
+
+	now func() time.Time // for testing
+}
+
+const defaultMaxAuthFailures = 5
+
+func (l *AuthFailureLimiter) maxFailures() int {
+	if l.MaxFailures <= 0 {
+		return defaultMaxAuthFailures
+	}
+	return l.MaxFailures
+}
+
+type authFailures struct {
+	count       int
+	since       time.Time
+	bannedUntil time.Time
+}
+
+func (l *AuthFailureLimiter) timeNow() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// Banned reports whether ip is currently banned.
+func (l *AuthFailureLimiter) Banned(ip net.IP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.timeNow()
+	l.prune(now)
+	f, ok := l.clients[ip.String()]
+	return ok && now.Before(f.bannedUntil)
+}
+
+// Fail records an authentication failure from ip.
+func (l *AuthFailureLimiter) Fail(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.timeNow()
+	l.prune(now)
+	if l.clients == nil {
+		l.clients = make(map[string]*authFailures)
+	}
+	key := ip.String()
+	f, ok := l.clients[key]
+	if !ok || now.Sub(f.since) > l.Window {
+		f = &authFailures{since: now}
+		l.clients[key] = f
+	}
+	f.count++
+	if f.count >= l.maxFailures() {
+		f.bannedUntil = now.Add(l.BanDuration)
+	}
+}
+
+// Reset forgets failures recorded for ip, such as to lift a ban manually.
+// The server never calls it.
+func (l *AuthFailureLimiter) Reset(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, ip.String())
+}
+
+// prune removes entries which no longer affect decisions. It runs at most
+// once per Window so that the cost is amortized.
+func (l *AuthFailureLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.Window {
+		return
+	}
+	l.lastPrune = now
+	for key, f := range l.clients {
+		if now.Sub(f.since) > l.Window && !now.Before(f.bannedUntil) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// ConnRateLimiter limits the rate of new connections from each client IP
+// with a token bucket. It is safe for concurrent use.
+type ConnRateLimiter struct {
+	// Conns is the number of connections allowed per Interval. It is also
+	// the burst size. Zero means no limit.
+	Conns int
+
+	// Interval is the period in which Conns connections are allowed.
+	Interval time.Duration
+
+	mu        sync.Mutex
+	clients   map[string]*connRate
+	lastPrune time.Time
+
+	now func() time.Time // for testing
+}
+
+type connRate struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func (l *ConnRateLimiter) timeNow() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// Allow reports whether a new connection from ip is allowed now.
+func (l *ConnRateLimiter) Allow(ip net.IP) bool {
+	if l.Conns <= 0 || l.Interval <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.timeNow()
+	l.prune(now)
+	if l.clients == nil {
+		l.clients = make(map[string]*connRate)
+	}
+	key := ip.String()
+	c, ok := l.clients[key]
+	if !ok {
+		every := rate.Every(l.Interval / time.Duration(l.Conns))
+		c = &connRate{limiter: rate.NewLimiter(every, l.Conns)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	return c.limiter.AllowN(now, 1)
+}
+
+// prune removes clients whose bucket has been refilled, which behave the
+// same as unknown clients. It runs at most once per Interval.
+func (l *ConnRateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.Interval {
+		return
+	}
+	l.lastPrune = now
+	for key, c := range l.clients {
+		if now.Sub(c.lastSeen) >= l.Interval {
+			delete(l.clients, key)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuthFailureLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := &AuthFailureLimiter{
+		MaxFailures: 3,
+		Window:      time.Minute,
+		BanDuration: 10 * time.Minute,
+		now:         func() time.Time { return now },
+	}
+	ip := net.ParseIP("192.0.2.1")
+	other := net.ParseIP("192.0.2.2")
+
+	for i := 0; i < 2; i++ {
+		l.Fail(ip)
+	}
+	if l.Banned(ip) {
+		t.Fatal("banned before reaching MaxFailures")
+	}
+	l.Fail(ip)
+	if !l.Banned(ip) {
+		t.Fatal("expected ip to be banned")
+	}
+	if l.Banned(other) {
+		t.Fatal("expected other ip not to be banned")
+	}
+
+	now = now.Add(10*time.Minute + time.Second)
+	if l.Banned(ip) {
+		t.Fatal("expected ban to be expired")
+	}
+	if len(l.clients) != 0 {
+		t.Fatalf("expected expired entries to be pruned, but %d remain", len(l.clients))
+	}
+
+	// failures outside of the window are not accumulated.
+	l.Fail(ip)
+	l.Fail(ip)
+	now = now.Add(2 * time.Minute)
+	l.Fail(ip)
+	if l.Banned(ip) {
+		t.Fatal("failures outside of window must not be counted")
+	}
+}
+
+func TestAuthFailureLimiter_DefaultMaxFailures(t *testing.T) {
+	l := &AuthFailureLimiter{
+		Window:      time.Minute,
+		BanDuration: 10 * time.Minute,
+	}
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < defaultMaxAuthFailures-1; i++ {
+		l.Fail(ip)
+		if l.Banned(ip) {
+			t.Fatalf("banned after %d failures", i+1)
+		}
+	}
+	l.Fail(ip)
+	if !l.Banned(ip) {
+		t.Fatalf("expected ip to be banned after %d failures", defaultMaxAuthFailures)
+	}
+}
+
+func TestConnRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := &ConnRateLimiter{
+		Conns:    3,
+		Interval: time.Minute,
+		now:      func() time.Time { return now },
+	}
+	ip := net.ParseIP("192.0.2.1")
+	other := net.ParseIP("192.0.2.2")
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow(ip) {
+			t.Fatalf("connection %d refused within the burst", i)
+		}
+	}
+	if l.Allow(ip) {
+		t.Fatal("expected connection over the limit to be refused")
+	}
+	if !l.Allow(other) {
+		t.Fatal("other ip must not be limited")
+	}
+
+	// a token is added every 20 seconds.
+	now = now.Add(20 * time.Second)
+	if !l.Allow(ip) {
+		t.Fatal("expected token to be refilled")
+	}
+	if l.Allow(ip) {
+		t.Fatal("expected only one token to be refilled")
+	}
+}
+
+func TestConnRateLimiter_Prune(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := &ConnRateLimiter{
+		Conns:    1,
+		Interval: time.Minute,
+		now:      func() time.Time { return now },
+	}
+	l.Allow(net.ParseIP("192.0.2.1"))
+	now = now.Add(2 * time.Minute)
+	l.Allow(net.ParseIP("192.0.2.2"))
+	if n := len(l.clients); n != 1 {
+		t.Fatalf("want 1 client after pruning, but got %d", n)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import "log"
+
+// Logger is the interface used by the server to report diagnostics.
+type Logger interface {
+	// Debugf reports events useful for tracing connections.
+	Debugf(format string, v ...interface{})
+
+	// Infof reports noteworthy events.
+	Infof(format string, v ...interface{})
+
+	// Errorf reports errors which the server has handled, such as a failed
+	// Accept or connection.
+	Errorf(format string, v ...interface{})
+}
+
+// stdLogger is the default Logger, which writes to l, or the standard
+// logger if l is nil. Debug messages are discarded unless debug is set.
+type stdLogger struct {
+	l     *log.Logger
+	debug bool
+}
+
+func (s stdLogger) Debugf(format string, v ...interface{}) {
+	if s.debug {
+		s.printf(format, v...)
+	}
+}
+
+func (s stdLogger) Infof(format string, v ...interface{}) {
+	s.printf(format, v...)
+}
+
+func (s stdLogger) Errorf(format string, v ...interface{}) {
+	s.printf(format, v...)
+}
+
+func (s stdLogger) printf(format string, v ...interface{}) {
+	if s.l != nil {
+		s.l.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// UserQuota limits resources consumed by each authenticated user.
+// Implementations must be safe for concurrent use, so that the state can
+// be kept in memory or shared storage such as Redis.
+type UserQuota interface {
+	// Acquire reserves a connection for user. It reports false if the
+	// user has reached the limit of concurrent connections.
+	Acquire(user string) bool
+
+	// Release releases the connection reserved by Acquire.
+	Release(user string)
+
+	// WaitN blocks until user is allowed to transfer n bytes.
+	WaitN(ctx context.Context, user string, n int) error
+}
+
+var _ UserQuota = (*MemoryQuota)(nil)
+
+// MemoryQuota is an in-memory UserQuota which applies the same limits to
+// every user.
+type MemoryQuota struct {
+	// MaxConns is the maximum number of concurrent connections per user.
+	// Zero means no limit.
+	MaxConns int
+
+	// BytesPerSecond is the aggregate bandwidth per user.
+	// Zero means no limit.
+	BytesPerSecond int
+
+	mu    sync.Mutex
+	users map[string]*userUsage
+}
+
+type userUsage struct {
+	conns   int
+	limiter *rate.Limiter
+	idle    time.Time // when conns has dropped to zero
+}
+
+// quotaRefillTime is how long the bandwidth of a user takes to refill,
+// since the burst is one second of BytesPerSecond.
+const quotaRefillTime = time.Second
+
+// Acquire implements UserQuota.
+func (q *MemoryQuota) Acquire(user string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.users == nil {
+		q.users = make(map[string]*userUsage)
+	}
+	u, ok := q.users[user]
+	if !ok {
+		u = &userUsage{}
+		if q.BytesPerSecond > 0 {
+			u.limiter = rate.NewLimiter(rate.Limit(q.BytesPerSecond), q.BytesPerSecond)
+		}
+		q.users[user] = u
+	}
+	if q.MaxConns > 0 && u.conns >= q.MaxConns {
+		return false
+	}
+	u.conns++
+	return true
+}
+
+// Release implements UserQuota.
+func (q *MemoryQuota) Release(user string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u, ok := q.users[user]
+	if !ok {
+		return
+	}
+	u.conns--
+	if u.conns > 0 {
+		return
+	}
+	if u.limiter == nil {
+		delete(q.users, user)
+		return
+	}
+	// keep the limiter until it has refilled, so that reconnecting does
+	// not reset the bandwidth of the user.
+	u.idle = time.Now()
+	time.AfterFunc(quotaRefillTime, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.users[user] == u && u.conns == 0 && time.Since(u.idle) >= quotaRefillTime {
+			delete(q.users, user)
+		}
+	})
+}
+
+// WaitN implements UserQuota.
+func (q *MemoryQuota) WaitN(ctx context.Context, user string, n int) error {
+	q.mu.Lock()
+	var limiter *rate.Limiter
+	if u, ok := q.users[user]; ok {
+		limiter = u.limiter
+	}
+	q.mu.Unlock()
+	if limiter == nil {
+		return nil
+	}
+	return waitN(ctx, limiter, n)
+}
+
+// waitN is like limiter.WaitN, but n may exceed the burst size.
+func waitN(ctx context.Context, limiter *rate.Limiter, n int) error {
+	burst := limiter.Burst()
+	for n > 0 {
+		m := n
+		if m > burst {
+			m = burst
+		}
+		if err := limiter.WaitN(ctx, m); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
+
+// quotaReader charges the bytes read to the user's bandwidth quota.
+type quotaReader struct {
+	ctx   context.Context
+	r     io.Reader
+	quota UserQuota
+	user  string
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.quota.WaitN(r.ctx, r.user, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// withoutDeadline hides the deadline of the relay context. rate.Limiter
+// fails a wait that would go past the deadline, whereas the relay should
+// run until RelayTimeout or MaxConnDuration actually expires and closes
+// the connections.
+type withoutDeadline struct {
+	context.Context
+}
+
+func (withoutDeadline) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// throttle applies Config.RateLimit, Config.GlobalRateLimit and the
+// bandwidth quota of the authenticated user to the data read from conn,
+// which is one direction of the relay.
+func (r *Request) throttle(ctx context.Context, conn io.Reader) io.Reader {
+	ctx = withoutDeadline{ctx}
+	if limiter := r.server.config.RateLimit.newLimiter(); limiter != nil {
+		conn = &limitReader{ctx: ctx, r: conn, limiter: limiter}
+	}
+	if limiter := r.server.globalLimiter; limiter != nil {
+		conn = &limitReader{ctx: ctx, r: conn, limiter: limiter}
+	}
+	quota := r.server.config.UserQuota
+	if quota == nil {
+		return conn
+	}
+	user, ok := UserFromContext(ctx)
+	if !ok {
+		return conn
+	}
+	return &quotaReader{
+		ctx:   ctx,
+		r:     conn,
+		quota: quota,
+		user:  user,
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestMemoryQuota_MaxConns(t *testing.T) {
+	q := &MemoryQuota{MaxConns: 1}
+	if !q.Acquire("alice") {
+		t.Fatal("expected first connection to be acquired")
+	}
+	if q.Acquire("alice") {
+		t.Fatal("expected second connection to be refused")
+	}
+	if !q.Acquire("bob") {
+		t.Fatal("expected other user to be independent")
+	}
+	q.Release("alice")
+	if !q.Acquire("alice") {
+		t.Fatal("expected connection to be acquired after release")
+	}
+}
+
+func TestMemoryQuota_BandwidthAcrossConns(t *testing.T) {
+	const bytesPerSecond = 100 * 1024
+	q := &MemoryQuota{BytesPerSecond: bytesPerSecond}
+
+	// the burst covers only the first connection.
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if !q.Acquire("alice") {
+			t.Fatal("expected connection to be acquired")
+		}
+		r := &quotaReader{
+			ctx:   context.Background(),
+			r:     bytes.NewReader(make([]byte, bytesPerSecond)),
+			quota: q,
+			user:  "alice",
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			t.Fatal(err)
+		}
+		q.Release("alice")
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Fatalf("transfer of the connections was not throttled together: %v", elapsed)
+	}
+}
+
+func TestMemoryQuota_Bandwidth(t *testing.T) {
+	const bytesPerSecond = 100 * 1024
+	q := &MemoryQuota{BytesPerSecond: bytesPerSecond}
+	if !q.Acquire("alice") {
+		t.Fatal("expected connection to be acquired")
+	}
+	defer q.Release("alice")
+
+	// the first second is covered by the burst.
+	data := bytes.Repeat([]byte{'a'}, bytesPerSecond*3/2)
+	r := &quotaReader{
+		ctx:   context.Background(),
+		r:     bytes.NewReader(data),
+		quota: q,
+		user:  "alice",
+	}
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("want %d bytes, but got %d", len(data), n)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("transfer was not throttled: %v", elapsed)
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is a token bucket limit of relayed bytes.
+type RateLimit struct {
+	// BytesPerSecond is the rate at which the bucket is refilled. Zero
+	// means no limit.
+	BytesPerSecond int
+
+	// Burst is the size of the bucket, which is the number of bytes which
+	// may be relayed at once. The default is BytesPerSecond.
+	Burst int
+}
+
+func (l *RateLimit) newLimiter() *rate.Limiter {
+	if l == nil || l.BytesPerSecond <= 0 {
+		return nil
+	}
+	burst := l.Burst
+	if burst <= 0 {
+		burst = l.BytesPerSecond
+	}
+	return rate.NewLimiter(rate.Limit(l.BytesPerSecond), burst)
+}
+
+// limitReader waits for the limiter before returning the bytes read.
+type limitReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := waitN(r.ctx, r.limiter, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -5,29 +5,66 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Code-Hex/socks5/internal/udputil"
 
 	"github.com/Code-Hex/socks5"
 	"github.com/Code-Hex/socks5/address"
 	"github.com/Code-Hex/socks5/internal/addrutil"
+	"golang.org/x/net/idna"
 	"golang.org/x/sync/errgroup"
 )
 
 var ErrCommandNotSupported = errors.New("command not supported")
 
+// ErrUnsupportedVersion returns when the client speaks other than SOCKS5.
+var ErrUnsupportedVersion = errors.New("unsupported version")
+
+// ErrNotAllowedByRuleSet returns when the request has been refused by
+// configured policy.
+var ErrNotAllowedByRuleSet = errors.New("connection not allowed by ruleset")
+
+// ErrAddressNotSupported returns when DST.ADDR of the request cannot be
+// used, such as an invalid internationalized domain name.
+var ErrAddressNotSupported = errors.New("address not supported")
+
+// ErrBindTimeout returns when no peer has connected to the listener of BIND
+// within Config.BindTimeout.
+var ErrBindTimeout = errors.New("bind timed out waiting for inbound connection")
+
 type Request struct {
 	Version  int
 	Command  socks5.Command
 	DestAddr *address.Info
 
-	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
-	Listen      func(ctx context.Context, network, address string) (net.Listener, error)
+	DialContext  func(ctx context.Context, network, address string) (net.Conn, error)
+	Listen       func(ctx context.Context, network, address string) (net.Listener, error)
+	ListenPacket func(ctx context.Context, network, address string) (net.PacketConn, error)
 
-	udpConn net.PacketConn
+	server *Socks5
+	conn   net.Conn   // the accepted connection, for Config.ConnState
+	debug  *debugConn // non-nil if Config.Debug is set
+	idle   *idleTimer // non-nil if Config.IdleTimeout is set
+	limit  *byteLimit // non-nil if Config.MaxBytesPerConn is set
+
+	// deadline is the end of Config.MaxRequestDuration, which bounds
+	// dialing the destination. It is zero if not set or once the relay has
+	// started, such as for the datagrams of UDP ASSOCIATE.
+	deadline time.Time
+
+	traffic traffic
+	timing  timing
+
+	destAddr address.Info // DestAddr points to it
+	buf      [3]byte      // to read the request
 }
 
 // NewRequest returns request
@@ -37,47 +74,149 @@ type Request struct {
 // +----+-----+-------+------+----------+----------+
 // | 1  |  1  | X'00' |  1   | Variable |    2     |
 // +----+-----+-------+------+----------+----------+
-func (s *Socks5) newRequest(s5conn io.Reader, udpConn net.PacketConn) (*Request, error) {
+func (s *Socks5) newRequest(s5conn io.Reader) (*Request, error) {
+	// the request is allocated first so that reading it uses its buffer
+	// and it holds DST.ADDR without allocating them separately.
+	r := &Request{
+		Version: socks5.Version,
+
+		DialContext:  s.config.DialContext,
+		Listen:       s.config.Listen,
+		ListenPacket: s.config.ListenPacket,
+		server:       s,
+	}
+
 	// read version, command, reserved.
-	header := make([]byte, 3)
-	if _, err := s5conn.Read(header); err != nil {
+	header := r.buf[:3]
+	if _, err := io.ReadFull(s5conn, header); err != nil {
 		return nil, fmt.Errorf("failed to get header information: %v", err)
 	}
 	// Ensure we are compatible
 	if header[0] != socks5.Version {
-		return nil, fmt.Errorf("unsupported version: %d", header[0])
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header[0])
 	}
+	r.Command = socks5.Command(header[1])
 
-	addr, err := addrutil.Read(s5conn)
-	if err != nil {
+	if err := r.readDestAddr(s5conn); err != nil {
 		return nil, err
 	}
+	r.DestAddr = &r.destAddr
+	return r, nil
+}
 
-	return &Request{
-		Version:  socks5.Version,
-		Command:  socks5.Command(header[1]),
-		DestAddr: addr,
+// readDestAddr reads ATYP, DST.ADDR and DST.PORT like addrutil.Read, but
+// with fewer allocations.
+func (r *Request) readDestAddr(s5conn io.Reader) error {
+	b := r.buf[:2]
+	if _, err := io.ReadFull(s5conn, b[:1]); err != nil {
+		return err
+	}
+	aTyp := address.Type(b[0])
+	var host []byte
+	switch aTyp {
+	case address.TypeIPv4:
+		host = make([]byte, net.IPv4len)
+	case address.TypeIPv6:
+		host = make([]byte, net.IPv6len)
+	case address.TypeFQDN:
+		if _, err := io.ReadFull(s5conn, b[:1]); err != nil {
+			return err
+		}
+		host = make([]byte, int(b[0]))
+	default:
+		return &address.Unrecognized{Type: aTyp}
+	}
+	if _, err := io.ReadFull(s5conn, host); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(s5conn, b); err != nil {
+		return err
+	}
+	if aTyp == address.TypeFQDN {
+		var err error
+		if host, err = normalizeFQDN(host); err != nil {
+			return err
+		}
+	}
+	r.destAddr = address.Info{
+		Type: aTyp,
+		Host: host,
+		Port: int(b[0])<<8 | int(b[1]),
+	}
+	return nil
+}
 
-		DialContext: s.config.DialContext,
-		Listen:      s.config.Listen,
-		udpConn:     udpConn,
-	}, nil
+// normalizeFQDN validates the domain name and converts the internationalized
+// one to punycode, since the resolver expects ASCII hostnames.
+func normalizeFQDN(host []byte) ([]byte, error) {
+	if len(host) == 0 {
+		return nil, fmt.Errorf("%w: empty domain name", ErrAddressNotSupported)
+	}
+	ascii := true
+	for _, c := range host {
+		switch {
+		case c <= ' ' || c == 0x7f:
+			return nil, fmt.Errorf("%w: invalid character in domain name", ErrAddressNotSupported)
+		case c >= utf8.RuneSelf:
+			ascii = false
+		}
+	}
+	if ascii {
+		return host, nil
+	}
+	if !utf8.Valid(host) {
+		return nil, fmt.Errorf("%w: invalid UTF-8 domain name", ErrAddressNotSupported)
+	}
+	punycode, err := idna.Lookup.ToASCII(string(host))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAddressNotSupported, err)
+	}
+	return []byte(punycode), nil
 }
 
 func (r *Request) do(ctx context.Context, s5conn net.Conn) (err error) {
-	switch r.Command {
-	case socks5.CmdConnect:
-		err = r.connect(ctx, s5conn)
-	case socks5.CmdBind:
-		err = r.bind(ctx, s5conn)
-	case socks5.CmdUDPAssociate:
-		err = r.udpAssociate(ctx, s5conn)
-	default:
-		err = ErrCommandNotSupported
+	start := time.Now()
+	status := socks5.StatusSucceeded
+	ctx, span := r.server.tracer().Start(ctx, "socks5.request")
+	span.SetAttribute("socks5.command", r.Command.String())
+	span.SetAttribute("socks5.destination", r.DestAddr.String())
+	defer func() {
+		span.SetAttribute("socks5.reply", int(status))
+		span.SetAttribute("socks5.duration", time.Since(start))
+		span.End()
+		r.logAccess(ctx, status, start)
+	}()
+
+	err = r.authorize(ctx)
+	if quota := r.server.config.UserQuota; err == nil && quota != nil {
+		if user, ok := UserFromContext(ctx); ok {
+			if quota.Acquire(user) {
+				defer quota.Release(user)
+			} else {
+				err = ErrNotAllowedByRuleSet
+			}
+		}
+	}
+
+	if err == nil {
+		switch r.Command {
+		case socks5.CmdConnect:
+			err = r.connect(ctx, s5conn)
+		case socks5.CmdBind:
+			err = r.bind(ctx, s5conn)
+		case socks5.CmdUDPAssociate:
+			err = r.udpAssociate(ctx, s5conn)
+		default:
+			err = ErrCommandNotSupported
+		}
 	}
 
 	if err != nil {
-		status := replyStatusByErr(err)
+		var re *relayError
+		if errors.As(err, &re) {
+			return err
+		}
+		status = replyStatusByErr(err)
 		if err := reply(s5conn, status, nil); err != nil {
 			return fmt.Errorf("failed to reply: %v", err)
 		}
@@ -86,28 +225,133 @@ func (r *Request) do(ctx context.Context, s5conn net.Conn) (err error) {
 	return nil
 }
 
-func replyStatusByErr(err error) socks5.Reply {
-	switch err := err.(type) {
-	case syscall.Errno:
-		switch err {
-		case syscall.ETIMEDOUT:
-			return socks5.StatusTTLExpired
-		case syscall.EPROTOTYPE,
-			syscall.EPROTONOSUPPORT,
-			syscall.EAFNOSUPPORT:
-			return socks5.StatusAddrTypeNotSupported
-		case syscall.ECONNREFUSED:
-			return socks5.StatusConnectionRefused
-		case syscall.ENETDOWN, syscall.ENETUNREACH:
-			return socks5.StatusNetworkUnreachable
-		case syscall.EHOSTUNREACH:
-			return socks5.StatusHostUnreachable
+// authorize applies the configured policies to the request.
+func (r *Request) authorize(ctx context.Context) error {
+	if !r.server.commandAllowed(r.Command) {
+		return ErrCommandNotSupported
+	}
+	if schedule := r.server.config.AccessSchedule; schedule != nil {
+		user, _ := UserFromContext(ctx)
+		if !schedule.Allowed(user) {
+			return fmt.Errorf("%w: outside of access schedule", ErrNotAllowedByRuleSet)
 		}
-	default:
-		if err == ErrCommandNotSupported {
-			return socks5.StatusCommandNotSupported
+	}
+	if r.Command == socks5.CmdConnect && r.server.domainBlocked(r.DestAddr) {
+		return ErrNotAllowedByRuleSet
+	}
+	if r.Command != socks5.CmdUDPAssociate && !r.server.portAllowed(r.DestAddr.Port) {
+		return ErrNotAllowedByRuleSet
+	}
+	// DST.ADDR of UDP ASSOCIATE is the client, so the rule set is applied
+	// to each datagram by relayUDP instead.
+	if rs := r.server.ruleSet(ctx); rs != nil && r.Command != socks5.CmdUDPAssociate &&
+		!r.checkRulesOnDial() && !rs.Allow(r.destHost(), r.DestAddr.Port, r.Command) {
+		return ErrNotAllowedByRuleSet
+	}
+	if authorize := r.server.config.Authorize; authorize != nil {
+		user, _ := UserFromContext(ctx)
+		if err := authorize(ctx, user, r.Command, r.DestAddr); err != nil {
+			return fmt.Errorf("%w: %v", ErrNotAllowedByRuleSet, err)
+		}
+	}
+	if filter := r.server.config.RequestFilter; filter != nil {
+		if allow, status := filter(r); !allow {
+			if status == socks5.StatusSucceeded {
+				status = socks5.StatusNotAllowedByRuleSet
+			}
+			return &filterError{status: status}
+		}
+	}
+	return nil
+}
+
+// checkRulesOnDial reports whether the rule set is evaluated against the
+// resolved IPs of DST.ADDR when dialing rather than by authorize.
+func (r *Request) checkRulesOnDial() bool {
+	return r.server.config.ResolveBeforeDial &&
+		r.Command == socks5.CmdConnect &&
+		r.DestAddr.Type == address.TypeFQDN
+}
+
+// filterError represents the request denied by Config.RequestFilter.
+type filterError struct {
+	status socks5.Reply
+}
+
+func (e *filterError) Error() string {
+	return fmt.Sprintf("request denied by filter: %s", e.status)
+}
+
+// ruleSet returns the rule set for the user authenticated on ctx.
+func (s *Socks5) ruleSet(ctx context.Context) *RuleSet {
+	if user, ok := UserFromContext(ctx); ok {
+		if rs, ok := s.config.UserRules[user]; ok {
+			return rs
 		}
 	}
+	return s.config.RuleSet
+}
+
+func (s *Socks5) domainBlocked(addr *address.Info) bool {
+	return addr.Type == address.TypeFQDN && s.blocklist.blocked(addr.Host.String())
+}
+
+// destHost returns the host of DST.ADDR.
+func (r *Request) destHost() string {
+	return hostString(r.DestAddr)
+}
+
+func hostString(addr *address.Info) string {
+	if addr.Type == address.TypeFQDN {
+		return addr.Host.String()
+	}
+	return net.IP(addr.Host).String()
+}
+
+// replyStatusByErr returns the reply code which represents err, such as
+// the error of dialing the destination.
+func replyStatusByErr(err error) socks5.Reply {
+	var fe *filterError
+	if errors.As(err, &fe) {
+		return fe.status
+	}
+	var (
+		re     *resolveError
+		dnsErr *net.DNSError
+	)
+	if errors.As(err, &re) || errors.As(err, &dnsErr) {
+		// the name of DST.ADDR could not be resolved.
+		return socks5.StatusHostUnreachable
+	}
+	switch {
+	case errors.Is(err, ErrCommandNotSupported):
+		return socks5.StatusCommandNotSupported
+	case errors.Is(err, ErrNotAllowedByRuleSet):
+		return socks5.StatusNotAllowedByRuleSet
+	case errors.Is(err, ErrAddressNotSupported):
+		return socks5.StatusAddrTypeNotSupported
+	case errors.Is(err, ErrBindTimeout):
+		return socks5.StatusHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5.StatusConnectionRefused
+	case errors.Is(err, syscall.ENETDOWN),
+		errors.Is(err, syscall.ENETUNREACH):
+		return socks5.StatusNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.EHOSTDOWN):
+		return socks5.StatusHostUnreachable
+	case errors.Is(err, syscall.EPROTOTYPE),
+		errors.Is(err, syscall.EPROTONOSUPPORT),
+		errors.Is(err, syscall.EAFNOSUPPORT):
+		return socks5.StatusAddrTypeNotSupported
+	case errors.Is(err, syscall.ETIMEDOUT),
+		errors.Is(err, context.DeadlineExceeded):
+		return socks5.StatusTTLExpired
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return socks5.StatusTTLExpired
+	}
 	return socks5.StatusGeneralServerFailure
 }
 
@@ -163,146 +407,602 @@ func reply(s5conn io.Writer, reply socks5.Reply, addr *address.Info) error {
 }
 
 func (r *Request) connect(ctx context.Context, s5conn net.Conn) error {
-	target, err := r.DialContext(ctx, "tcp", r.DestAddr.String())
+	target, err := r.dialTarget(ctx, "tcp", r.DestAddr)
 	if err != nil {
 		return err
 	}
 	defer target.Close()
 
-	// TODO(codehex): it should pass the local address information?
-	if err := reply(s5conn, socks5.StatusSucceeded, nil); err != nil {
+	bind, err := r.boundAddr(target.LocalAddr())
+	if err != nil {
+		return err
+	}
+	if err := reply(s5conn, socks5.StatusSucceeded, bind); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
-	return transport(s5conn, target)
+	return r.relay(ctx, s5conn, target)
 }
 
+// bind listens for exactly one inbound connection from the peer, such as
+// the data connection of FTP, and relays it to the client. DST.ADDR and
+// DST.PORT are not used to restrict the peer.
+//
+// The server sends two replies: the first one carries the address which
+// the listener is bound to, and the second one carries the address of the
+// connected peer.
 func (r *Request) bind(ctx context.Context, s5conn net.Conn) error {
-	target, err := r.DialContext(ctx, "tcp", r.DestAddr.String())
+	// listen on the interface which the client has reached.
+	host, _, err := net.SplitHostPort(s5conn.LocalAddr().String())
 	if err != nil {
 		return err
 	}
-	defer target.Close()
-
-	ln, err := r.Listen(ctx, "tcp", "127.0.0.1:0")
+	ln, err := r.Listen(ctx, "tcp", net.JoinHostPort(host, "0"))
 	if err != nil {
 		return err
 	}
+	defer ln.Close()
 
-	hostStr, port, err := addrutil.SplitHostPort(ln.Addr().String())
+	bind, err := r.boundAddr(ln.Addr())
 	if err != nil {
 		return err
 	}
+	if err := reply(s5conn, socks5.StatusSucceeded, bind); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
 
-	aTyp, host, err := addrutil.GetAddressInfo(hostStr)
+	peer, err := acceptOne(ctx, ln, r.server.config.BindTimeout)
 	if err != nil {
 		return err
 	}
+	defer peer.Close()
 
-	bind := &address.Info{
-		Host: host,
-		Port: port,
-		Type: aTyp,
+	peerAddr, err := newAddressInfo(peer.RemoteAddr())
+	if err != nil {
+		return err
 	}
-
-	if err := reply(s5conn, socks5.StatusSucceeded, bind); err != nil {
+	if err := reply(s5conn, socks5.StatusSucceeded, peerAddr); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
+	return r.relay(ctx, s5conn, peer)
+}
 
+// acceptOne accepts the first connection within timeout and then closes ln
+// so that any other connections are refused. It gives up when ctx is done,
+// such as when Shutdown is called.
+func acceptOne(ctx context.Context, ln net.Listener, timeout time.Duration) (net.Conn, error) {
+	defer ln.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
+	var expired int32
+	if d, ok := ln.(interface{ SetDeadline(time.Time) error }); ok {
+		d.SetDeadline(time.Now().Add(timeout))
+	} else {
+		t := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&expired, 1)
+			ln.Close()
+		})
+		defer t.Stop()
+	}
 	for {
-		c, err := ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				time.Sleep(1 * time.Second)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			ne, ok := err.(net.Error)
+			if (ok && ne.Timeout()) || atomic.LoadInt32(&expired) == 1 {
+				return nil, ErrBindTimeout
+			}
+			if ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
 				continue
 			}
-			return err
+			return nil, err
 		}
-		return transport(target, c)
+		return conn, nil
 	}
 }
 
-func transport(dst, src io.ReadWriter) error {
+// boundAddr returns BND.ADDR and BND.PORT reported for the local address.
+func (r *Request) boundAddr(addr net.Addr) (*address.Info, error) {
+	bind, err := newAddressInfo(addr)
+	if err != nil {
+		return nil, err
+	}
+	if advertised := r.server.config.AdvertisedAddr; advertised != "" {
+		aTyp, host, err := addrutil.GetAddressInfo(advertised)
+		if err != nil {
+			return nil, err
+		}
+		bind.Type, bind.Host = aTyp, host
+	}
+	return bind, nil
+}
+
+func newAddressInfo(addr net.Addr) (*address.Info, error) {
+	// use the IP as is so that IPv6 addresses with zone are reported
+	// as ATYP X'04'.
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return newIPAddressInfo(addr.IP, addr.Port), nil
+	case *net.UDPAddr:
+		return newIPAddressInfo(addr.IP, addr.Port), nil
+	}
+	hostStr, port, err := addrutil.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	aTyp, host, err := addrutil.GetAddressInfo(hostStr)
+	if err != nil {
+		return nil, err
+	}
+	return &address.Info{
+		Host: host,
+		Port: port,
+		Type: aTyp,
+	}, nil
+}
+
+func newIPAddressInfo(ip net.IP, port int) *address.Info {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &address.Info{Host: address.Host(ip4), Port: port, Type: address.TypeIPv4}
+	}
+	if ip == nil {
+		ip = net.IPv6unspecified
+	}
+	return &address.Info{Host: address.Host(ip.To16()), Port: port, Type: address.TypeIPv6}
+}
+
+// relay copies data between the client and the target in both directions
+// until both of them reach EOF or ctx is done. EOF of one direction is
+// propagated with CloseWrite so that the other direction can still be used.
+func (r *Request) relay(ctx context.Context, client, target net.Conn) error {
+	r.startRelaying()
+	if dc, ok := client.(*debugConn); ok {
+		// relay with the underlying connection, such as to splice.
+		client = dc.Conn
+	}
+	if timeout := r.server.config.IdleTimeout; timeout > 0 {
+		r.idle = newIdleTimer(timeout)
+	}
+	if max := r.server.config.MaxBytesPerConn; max > 0 {
+		r.limit = &byteLimit{remaining: max}
+	}
+	if timeout := r.server.config.RelayTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// closing the connections interrupts the copies when Shutdown is called
+	// or RelayTimeout expires.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+			target.Close()
+		case <-stop:
+		}
+	}()
+	noDelay := !r.server.config.DisableNoDelay
+	setNoDelay(client, noDelay)
+	setNoDelay(target, noDelay)
+	if period := r.server.config.KeepAlive; period != 0 {
+		setKeepAlive(client, period)
+		setKeepAlive(target, period)
+	}
 	var eg errgroup.Group
 	eg.Go(func() error {
-		_, err := io.Copy(dst, src)
+		n, err := r.pipe(ctx, target, client)
+		r.traffic.addSent(n)
 		return err
 	})
 	eg.Go(func() error {
-		_, err := io.Copy(src, dst)
+		n, err := r.pipe(ctx, client, target)
+		r.traffic.addReceived(n)
 		return err
 	})
-	return eg.Wait()
+	err := eg.Wait()
+	r.reportTransfer()
+	if err != nil && !isClosedError(err) && ctx.Err() == nil {
+		return &relayError{err: err}
+	}
+	return nil
 }
 
-const maxBufferSize = 1024
+// setNoDelay sets TCP_NODELAY on conn if it is a TCP connection such as
+// *net.TCPConn.
+func setNoDelay(conn net.Conn, noDelay bool) {
+	if c, ok := conn.(interface{ SetNoDelay(bool) error }); ok {
+		c.SetNoDelay(noDelay)
+	}
+}
 
-func (r *Request) udpAssociate(ctx context.Context, s5conn net.Conn) error {
+// setKeepAlive enables TCP keep-alives with period on conn if it is a TCP
+// connection, or disables them if period is negative.
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	c, ok := conn.(interface {
+		SetKeepAlive(bool) error
+		SetKeepAlivePeriod(time.Duration) error
+	})
+	if !ok {
+		return
+	}
+	if period < 0 {
+		c.SetKeepAlive(false)
+		return
+	}
+	c.SetKeepAlive(true)
+	c.SetKeepAlivePeriod(period)
+}
+
+// relayError represents the error which occurs after the final reply has
+// been sent, so no more reply is sent for it.
+type relayError struct {
+	err error
+}
+
+func (e *relayError) Error() string { return e.err.Error() }
+func (e *relayError) Unwrap() error { return e.err }
+
+// isClosedError reports whether err is an expected way for a relayed
+// connection to terminate.
+func isClosedError(err error) bool {
+	if errors.Is(err, io.EOF) ||
+		errors.Is(err, errIdle) ||
+		errors.Is(err, errByteLimit) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	// net.ErrClosed is not available before Go 1.16.
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
 
-	udpConnAddr := r.udpConn.LocalAddr()
+// pipe copies from src to dst. On error, both connections are closed to
+// abort the other direction.
+//
+// dst and src must not be wrapped unless it is necessary. If both of them are
+// *net.TCPConn, the copy is done by the kernel with splice(2) on Linux, which
+// saves copying through user space.
+func (r *Request) pipe(ctx context.Context, dst, src net.Conn) (int64, error) {
+	var reader io.Reader = src
+	if r.idle != nil {
+		reader = &idleReader{conn: src, timer: r.idle}
+	}
+	if r.limit != nil {
+		reader = &byteLimitReader{r: reader, limit: r.limit}
+	}
+	n, err := r.server.buffers.copy(dst, r.throttle(ctx, reader))
+	if err != nil {
+		dst.Close()
+		src.Close()
+		return n, err
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		// the error is not interesting since the peer may have gone.
+		cw.CloseWrite()
+	}
+	return n, nil
+}
 
-	hostStr, port, err := addrutil.SplitHostPort(udpConnAddr.String())
+// udpAssociate relays datagrams of the client through the socket dedicated
+// to this association, which is closed when the association ends.
+func (r *Request) udpAssociate(ctx context.Context, s5conn net.Conn) error {
+	// listen on the interface which the client has reached.
+	host, _, err := net.SplitHostPort(s5conn.LocalAddr().String())
 	if err != nil {
 		return err
 	}
-
-	aTyp, host, err := addrutil.GetAddressInfo(hostStr)
+	udpConn, err := r.ListenPacket(ctx, "udp", net.JoinHostPort(host, "0"))
 	if err != nil {
 		return err
 	}
+	defer udpConn.Close()
 
-	relay := &address.Info{
-		Host: host,
-		Port: port,
-		Type: aTyp,
+	client := r.udpClientAddr(s5conn)
+
+	relay, err := r.boundAddr(udpConn.LocalAddr())
+	if err != nil {
+		return err
 	}
 
 	if err := reply(s5conn, socks5.StatusSucceeded, relay); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
-	for {
-		r.udpConn.SetDeadline(time.Now().Add(5 * time.Second))
+	// A UDP association terminates when the TCP connection that the
+	// UDP ASSOCIATE request arrived on terminates.
+	controlClosed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, s5conn)
+		close(controlClosed)
+		udpConn.Close()
+	}()
+	// closing the socket ends the association when Shutdown is called.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			udpConn.Close()
+		case <-stop:
+		}
+	}()
+
+	r.startRelaying()
+	err = r.relayUDP(ctx, udpConn, client, controlClosed)
+	r.reportTransfer()
+	if err != nil {
+		return &relayError{err: err}
+	}
+	return nil
+}
 
-		frame := make([]byte, maxBufferSize)
-		n, remoteAddr, err := r.udpConn.ReadFrom(frame)
+// startRelaying is called when the request has succeeded and starts
+// relaying data.
+func (r *Request) startRelaying() {
+	r.deadline = time.Time{}
+	if r.debug != nil {
+		r.debug.stop()
+	}
+	r.server.setState(r.conn, StateRelaying)
+}
+
+// relayUDP relays datagrams between the client and destinations until the
+// association ends or ctx is done. Datagrams which cannot be delivered to
+// their destination are dropped without ending the association.
+func (r *Request) relayUDP(ctx context.Context, udpConn net.PacketConn, client *udpClient, controlClosed <-chan struct{}) error {
+	// the extra byte detects datagrams which are larger than the buffer.
+	bufSize := r.server.config.UDPBufferSize
+	frame := make([]byte, bufSize+1)
+	idleTimeout := r.server.config.UDPIdleTimeout
+	if idleTimeout > 0 {
+		udpConn.SetReadDeadline(time.Now().Add(idleTimeout))
+	}
+	targets := &udpTargets{conns: make(map[string]net.Conn)}
+	defer targets.close()
+	for {
+		n, remoteAddr, err := udpConn.ReadFrom(frame)
 		if err != nil {
+			select {
+			case <-controlClosed:
+				return nil
+			default:
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err := targets.err(); err != nil {
+				return err
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// the association has been idle.
+				return nil
+			}
 			return err
 		}
+		if !r.server.config.AllowAnyUDPSource && !client.match(remoteAddr) {
+			// drop datagrams from other than the client.
+			continue
+		}
+
+		if n > bufSize {
+			// drop truncated datagrams.
+			continue
+		}
 
 		buf, addr, err := udputil.ExtractData(frame[:n])
 		if err != nil {
-			return err
+			// drop fragments and malformed datagrams.
+			continue
+		}
+		if r.server.domainBlocked(addr) || !r.server.portAllowed(addr.Port) {
+			continue
+		}
+		if rs := r.server.ruleSet(ctx); rs != nil && !rs.Allow(hostString(addr), addr.Port, socks5.CmdUDPAssociate) {
+			continue
 		}
 
-		dst := make([]byte, maxBufferSize)
-		nn, err := r.dialUDP(context.Background(), addr, buf, dst)
+		if rewrite := r.server.config.UDPRewrite; rewrite != nil {
+			if buf = rewrite(Outbound, remoteAddr, &udpAddr{addr}, buf); buf == nil {
+				continue
+			}
+		}
+
+		key := remoteAddr.String() + " " + addr.String()
+		targetConn := targets.get(key)
+		if targetConn == nil {
+			targetConn, err = r.dialTarget(ctx, "udp", addr)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				// drop datagrams to destinations which cannot be resolved
+				// or are denied by policies such as DenyPrivateNetworks.
+				continue
+			}
+			targets.add(key, targetConn)
+			go r.relayUDPReplies(udpConn, targets, key, targetConn, remoteAddr, addr)
+		}
+		targetConn.SetReadDeadline(time.Now().Add(udpReplyTimeout))
+		if _, err := targetConn.Write(buf); err != nil {
+			continue
+		}
+		r.traffic.addSent(int64(len(buf)))
+	}
+}
+
+// udpReplyTimeout is how long the socket dialed to a destination of UDP
+// ASSOCIATE waits for replies after the last datagram sent through it.
+const udpReplyTimeout = 5 * time.Second
+
+// relayUDPReplies relays datagrams from a destination to the client until
+// no reply arrives within udpReplyTimeout.
+func (r *Request) relayUDPReplies(udpConn net.PacketConn, targets *udpTargets, key string, targetConn net.Conn, client net.Addr, addr *address.Info) {
+	defer targets.remove(key, targetConn)
+	bufSize := r.server.config.UDPBufferSize
+	buf := make([]byte, bufSize+1)
+	rewrite := r.server.config.UDPRewrite
+	target := &udpAddr{addr}
+	for {
+		n, err := targetConn.Read(buf)
 		if err != nil {
-			return err
+			return
+		}
+		if n > bufSize {
+			continue
+		}
+		data := buf[:n]
+		if rewrite != nil {
+			if data = rewrite(Inbound, target, client, data); data == nil {
+				continue
+			}
 		}
 
-		dest := udputil.CreateFrame(addr.Type, addr.Port, addr.Host, dst[:nn])
-		if _, err := r.udpConn.WriteTo(dest, remoteAddr); err != nil {
-			return err
+		dest := udputil.CreateFrame(addr.Type, addr.Port, addr.Host, data)
+		if _, err := udpConn.WriteTo(dest, client); err != nil {
+			// closing the socket ends the association with err.
+			targets.fail(err)
+			udpConn.Close()
+			return
+		}
+		r.traffic.addReceived(int64(len(data)))
+		if timeout := r.server.config.UDPIdleTimeout; timeout > 0 {
+			udpConn.SetReadDeadline(time.Now().Add(timeout))
 		}
 	}
 }
 
-func (r *Request) dialUDP(ctx context.Context, addr *address.Info, in, out []byte) (int, error) {
-	targetConn, err := r.DialContext(ctx, "udp", addr.String())
-	if err != nil {
-		return 0, err
+// udpTargets holds the sockets dialed to the destinations of a UDP
+// association, keyed by the client and destination addresses.
+type udpTargets struct {
+	mu    sync.Mutex
+	conns map[string]net.Conn
+	werr  error
+	wg    sync.WaitGroup
+}
+
+func (t *udpTargets) get(key string) net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conns[key]
+}
+
+func (t *udpTargets) add(key string, conn net.Conn) {
+	t.mu.Lock()
+	t.conns[key] = conn
+	t.mu.Unlock()
+	t.wg.Add(1)
+}
+
+func (t *udpTargets) remove(key string, conn net.Conn) {
+	t.mu.Lock()
+	if t.conns[key] == conn {
+		delete(t.conns, key)
 	}
-	defer targetConn.Close()
-	targetConn.SetDeadline(time.Now().Add(time.Second * 5))
+	t.mu.Unlock()
+	conn.Close()
+	t.wg.Done()
+}
 
-	if _, err := targetConn.Write(in); err != nil {
-		return 0, err
+// fail records the error of relaying replies to the client.
+func (t *udpTargets) fail(err error) {
+	t.mu.Lock()
+	if t.werr == nil {
+		t.werr = err
 	}
+	t.mu.Unlock()
+}
 
-	n, err := targetConn.Read(out)
-	if err != nil {
-		return 0, err
+func (t *udpTargets) err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.werr
+}
+
+// close closes the sockets and waits for their replies to be relayed.
+func (t *udpTargets) close() {
+	t.mu.Lock()
+	for _, conn := range t.conns {
+		conn.Close()
 	}
-	return n, nil
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+// Direction represents the direction of relayed data.
+type Direction int
+
+const (
+	// Outbound is the direction from the client to the destination.
+	Outbound Direction = iota
+
+	// Inbound is the direction from the destination to the client.
+	Inbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Outbound:
+		return "outbound"
+	case Inbound:
+		return "inbound"
+	}
+	return "unknown"
+}
+
+// udpAddr represents the destination of a datagram as net.Addr.
+// The host may be FQDN.
+type udpAddr struct {
+	*address.Info
+}
+
+func (a *udpAddr) Network() string { return "udp" }
+
+// udpClient represents the address which the client sends datagrams from.
+// The zero port matches any port.
+type udpClient struct {
+	ip   net.IP
+	port int
+}
+
+// udpClientAddr returns the address of the client reported by the request.
+// If the client has not specified the IP, the IP of the control connection
+// is used instead.
+func (r *Request) udpClientAddr(s5conn net.Conn) *udpClient {
+	client := &udpClient{port: r.DestAddr.Port}
+	if r.DestAddr.Type != address.TypeFQDN {
+		if ip := net.IP(r.DestAddr.Host); !ip.IsUnspecified() {
+			client.ip = ip
+		}
+	}
+	if client.ip == nil {
+		client.ip = remoteIP(s5conn)
+	}
+	return client
+}
+
+func (c *udpClient) match(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	if !c.ip.Equal(udpAddr.IP) {
+		return false
+	}
+	return c.port == 0 || c.port == udpAddr.Port
 }
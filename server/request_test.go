@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/socks5"
+)
+
+func TestServeConn_CleanCompletion(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := New(nil)
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- s.serveConn(context.Background(), conn)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	port := target.Addr().(*net.TCPAddr).Port
+	msg := []byte{
+		socks5.Version, 1, 0, // no authentication required
+		socks5.Version, byte(socks5.CmdConnect), 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port),
+	}
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// method selection (2), reply (10) and the echo.
+	if want := 2 + 10 + len("hello"); len(b) != want {
+		t.Fatalf("want %d bytes, but got %d bytes", want, len(b))
+	}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("want nil, but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveConn has not returned")
+	}
+}
+
+// tcpPair returns both ends of a TCP connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	peer := <-accepted
+	if peer == nil {
+		tb.Fatal("failed to accept")
+	}
+	return conn, peer
+}
+
+// wrappedConn hides the type of the connection, which prevents splice(2).
+type wrappedConn struct{ net.Conn }
+
+// BenchmarkPipe compares relaying *net.TCPConn, which splices on Linux,
+// with relaying through user space.
+func BenchmarkPipe(b *testing.B) {
+	b.Run("TCPConn", func(b *testing.B) {
+		benchmarkPipe(b, func(c net.Conn) net.Conn { return c })
+	})
+	b.Run("Wrapped", func(b *testing.B) {
+		benchmarkPipe(b, func(c net.Conn) net.Conn { return wrappedConn{c} })
+	})
+}
+
+func benchmarkPipe(b *testing.B, wrap func(net.Conn) net.Conn) {
+	client, src := tcpPair(b)
+	dst, target := tcpPair(b)
+	defer client.Close()
+	defer target.Close()
+
+	r := &Request{server: New(nil)}
+	done := make(chan struct{})
+	go func() {
+		r.pipe(context.Background(), wrap(dst), wrap(src))
+		close(done)
+	}()
+	go io.Copy(ioutil.Discard, target)
+
+	chunk := make([]byte, 128*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	client.Close()
+	<-done
+}
+
+func BenchmarkNewRequest(b *testing.B) {
+	cases := []struct {
+		name string
+		msg  []byte
+	}{
+		{"IPv4", []byte{socks5.Version, byte(socks5.CmdConnect), 0, 1, 192, 0, 2, 1, 0, 80}},
+		{"FQDN", append(append([]byte{socks5.Version, byte(socks5.CmdConnect), 0, 3, 11}, "example.com"...), 1, 187)},
+	}
+	s := New(nil)
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			r := bytes.NewReader(tc.msg)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.Reset(tc.msg)
+				if _, err := s.newRequest(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
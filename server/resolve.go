@@ -0,0 +1,382 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Code-Hex/socks5/address"
+)
+
+// happyEyeballsDelay is the delay before the fallback address family is
+// dialed with Config.HappyEyeballs. It is the value recommended by RFC 8305
+// and used by net.Dialer.
+const happyEyeballsDelay = 300 * time.Millisecond
+
+// Resolver looks up IP addresses of domain names. *net.Resolver satisfies
+// the interface.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// AddressFamily represents the IP version used for domain destinations.
+type AddressFamily int
+
+const (
+	// AddressFamilyAuto uses any address of domain destinations.
+	AddressFamilyAuto AddressFamily = iota
+
+	// AddressFamilyIPv4 uses only IPv4 addresses.
+	AddressFamilyIPv4
+
+	// AddressFamilyIPv6 uses only IPv6 addresses.
+	AddressFamilyIPv6
+)
+
+func (f AddressFamily) String() string {
+	switch f {
+	case AddressFamilyAuto:
+		return "auto"
+	case AddressFamilyIPv4:
+		return "IPv4"
+	case AddressFamilyIPv6:
+		return "IPv6"
+	}
+	return "unknown address family " + strconv.Itoa(int(f))
+}
+
+func (f AddressFamily) match(ip net.IP) bool {
+	switch f {
+	case AddressFamilyIPv4:
+		return ip.To4() != nil
+	case AddressFamilyIPv6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// dialTarget dials the destination addr on network. If a policy applies to
+// destination IPs, a domain name is resolved first so that the policy is
+// checked against the IPs which are actually dialed.
+func (r *Request) dialTarget(ctx context.Context, network string, addr *address.Info) (net.Conn, error) {
+	if !r.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, r.deadline)
+		defer cancel()
+	}
+	start, resolving := time.Now(), r.timing.resolve
+	conn, err := r.resolveAndDial(ctx, network, addr)
+	r.timing.dial += time.Since(start) - (r.timing.resolve - resolving)
+	return conn, err
+}
+
+func (r *Request) resolveAndDial(ctx context.Context, network string, addr *address.Info) (net.Conn, error) {
+	s := r.server
+	if addr.Type != address.TypeFQDN {
+		if !s.destIPAllowed(net.IP(addr.Host)) {
+			return nil, fmt.Errorf("%w: %s", ErrNotAllowedByRuleSet, addr)
+		}
+		return r.dial(ctx, network, addr.String())
+	}
+	if !s.resolveBeforeDial() {
+		return r.dial(ctx, network, addr.String())
+	}
+
+	host := addr.Host.String()
+	start := time.Now()
+	ips, err := s.lookupIPTimeout(ctx, host)
+	r.timing.resolve += time.Since(start)
+	if err != nil {
+		return nil, &resolveError{host: host, err: err}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address for %s: %w", host, syscall.EHOSTUNREACH)
+	}
+	if family := s.config.AddressFamily; family != AddressFamilyAuto {
+		ips = filterIPs(ips, family.match)
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no %s address for %s: %w", family, host, syscall.EHOSTUNREACH)
+		}
+	}
+	ips = filterIPs(ips, s.destIPAllowed)
+	if rs := s.ruleSet(ctx); rs != nil && r.checkRulesOnDial() {
+		ips = filterIPs(ips, func(ip net.IP) bool {
+			return rs.allowResolved(host, ip, addr.Port, r.Command)
+		})
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotAllowedByRuleSet, host)
+	}
+	port := strconv.Itoa(addr.Port)
+	if s.config.HappyEyeballs && isStreamNetwork(network) {
+		primaries, fallbacks := partitionIPs(ips)
+		if len(fallbacks) > 0 {
+			return r.dialParallel(ctx, network, primaries, fallbacks, port)
+		}
+	}
+	return r.dialSerial(ctx, network, ips, port)
+}
+
+// dial calls DialContext with Config.DialTimeout, retrying as configured by
+// Config.DialRetries.
+func (r *Request) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	delay := r.server.config.DialRetryDelay
+	for retries := r.server.config.DialRetries; ; retries-- {
+		conn, err := r.dialOnce(ctx, network, address)
+		if err == nil || retries <= 0 || ctx.Err() != nil {
+			return conn, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+func (r *Request) dialOnce(ctx context.Context, network, address string) (net.Conn, error) {
+	if timeout := r.server.config.DialTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return r.DialContext(ctx, network, address)
+}
+
+// dialSerial dials ips in order and returns the first established
+// connection.
+func (r *Request) dialSerial(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := r.dial(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// dialParallel races primaries against fallbacks as described in RFC 8305.
+// The fallbacks are dialed when happyEyeballsDelay has passed or the
+// primaries have failed, whichever comes first.
+func (r *Request) dialParallel(ctx context.Context, network string, primaries, fallbacks []net.IP, port string) (net.Conn, error) {
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, 2) // never blocks the losing dial
+	dial := func(ips []net.IP, primary bool) {
+		conn, err := r.dialSerial(ctx, network, ips, port)
+		results <- dialResult{conn: conn, err: err, primary: primary}
+	}
+	go dial(primaries, true)
+
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+
+	var primaryErr, fallbackErr error
+	for pending, fallbackStarted := 1, false; pending > 0; {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go dial(fallbacks, false)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// cancel the other attempt and close its connection if
+					// it completes anyway.
+					cancel()
+					go func() {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+				if !fallbackStarted {
+					fallbackStarted = true
+					pending++
+					go dial(fallbacks, false)
+				}
+			} else {
+				fallbackErr = res.err
+			}
+		}
+	}
+	if primaryErr != nil {
+		return nil, primaryErr
+	}
+	return nil, fallbackErr
+}
+
+// partitionIPs divides ips into those of the same family as the first one
+// and the others.
+func partitionIPs(ips []net.IP) (primaries, fallbacks []net.IP) {
+	isIPv4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == isIPv4 {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	return primaries, fallbacks
+}
+
+func isStreamNetwork(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	}
+	return false
+}
+
+// resolveBeforeDial reports whether domain names must be resolved by the
+// server before dialing.
+func (s *Socks5) resolveBeforeDial() bool {
+	return s.config.ResolveBeforeDial ||
+		s.config.Resolver != nil ||
+		s.config.ResolveFunc != nil ||
+		s.dnsCache != nil ||
+		s.config.HappyEyeballs ||
+		s.config.AddressFamily != AddressFamilyAuto ||
+		s.config.GeoIPPolicy != nil ||
+		s.config.DenyPrivateNetworks
+}
+
+func (s *Socks5) destIPAllowed(ip net.IP) bool {
+	if s.config.DenyPrivateNetworks && isPrivateIP(ip) {
+		return false
+	}
+	if policy := s.config.GeoIPPolicy; policy != nil && !policy(ip) {
+		return false
+	}
+	return true
+}
+
+// resolveError represents the failure to resolve a destination domain name,
+// which is replied with X'04' Host unreachable.
+type resolveError struct {
+	host string
+	err  error
+}
+
+func (e *resolveError) Error() string {
+	return fmt.Sprintf("resolving %s: %v", e.host, e.err)
+}
+
+func (e *resolveError) Unwrap() error { return e.err }
+
+// lookupIPTimeout is like lookupIP, but gives up after
+// Config.ResolveTimeout.
+func (s *Socks5) lookupIPTimeout(ctx context.Context, host string) ([]net.IP, error) {
+	timeout := s.config.ResolveTimeout
+	if timeout <= 0 {
+		return s.lookupIP(ctx, host)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return s.lookupIP(ctx, host)
+}
+
+// lookupIP returns the IPs of host. The returned slice must not be
+// modified since it may be shared through the cache.
+func (s *Socks5) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if s.dnsCache == nil {
+		return s.resolve(ctx, host)
+	}
+	key := normalizeDomain(host)
+	if e, ok := s.dnsCache.get(key); ok {
+		return e.ips, e.err
+	}
+	ips, err := s.resolve(ctx, host)
+	if ctx.Err() == nil {
+		// a lookup aborted by the client is not the result for others.
+		s.dnsCache.put(key, ips, err)
+	}
+	return ips, err
+}
+
+func (s *Socks5) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if fn := s.config.ResolveFunc; fn != nil {
+		return fn(ctx, host)
+	}
+	var resolver Resolver = net.DefaultResolver
+	if s.config.Resolver != nil {
+		resolver = s.config.Resolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+func filterIPs(ips []net.IP, keep func(net.IP) bool) []net.IP {
+	var filtered []net.IP
+	for _, ip := range ips {
+		if keep(ip) {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
+
+// privateNetworks is the list of networks refused by
+// Config.DenyPrivateNetworks.
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // RFC 1918
+	"100.64.0.0/10",  // shared address space
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local
+	"172.16.0.0/12",  // RFC 1918
+	"192.168.0.0/16", // RFC 1918
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return containsIP(privateNetworks, ip)
+}
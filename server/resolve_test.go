@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	cases := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"::", true},
+		{"fd12:3456::1", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"192.0.2.1", false},
+		{"2001:db8::1", false},
+	}
+	for _, tc := range cases {
+		if got := isPrivateIP(net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"net"
+	"runtime"
+)
+
+// ServeReusePort creates n listeners bound to addr with SO_REUSEPORT and
+// serves on all of them, so that the kernel balances incoming connections
+// across goroutines accepting in parallel. If n is not positive, the number
+// of CPUs is used. It returns when any of the listeners fails, after
+// closing the others.
+func (s *Socks5) ServeReusePort(network, addr string, n int) error {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	ls, err := listenReusePort(s.ctx, network, addr, n)
+	if err != nil {
+		return err
+	}
+	return s.serveListeners(ls)
+}
+
+// listenReusePort creates n listeners which share the address. The first
+// listener determines the address, such as when the port of addr is 0.
+func listenReusePort(ctx context.Context, network, addr string, n int) ([]net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	ls := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := lc.Listen(ctx, network, addr)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		addr = l.Addr().String()
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// serveListeners calls Serve for each of ls concurrently and returns the
+// first error.
+func (s *Socks5) serveListeners(ls []net.Listener) error {
+	errCh := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l net.Listener) {
+			errCh <- s.Serve(l)
+		}(l)
+	}
+	err := <-errCh
+	for _, l := range ls {
+		l.Close()
+	}
+	for i := 1; i < len(ls); i++ {
+		<-errCh
+	}
+	return err
+}
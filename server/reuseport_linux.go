@@ -0,0 +1,8 @@
+//go:build !mips && !mipsle && !mips64 && !mips64le
+// +build !mips,!mipsle,!mips64,!mips64le
+
+package server
+
+// soReusePort is SO_REUSEPORT, which syscall does not define on most Linux
+// architectures.
+const soReusePort = 0xf
@@ -0,0 +1,8 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd || (linux && mips) || (linux && mipsle) || (linux && mips64) || (linux && mips64le)
+// +build darwin dragonfly freebsd netbsd openbsd linux,mips linux,mipsle linux,mips64 linux,mips64le
+
+package server
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
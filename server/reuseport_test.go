@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingListener counts accepted connections.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestServeReusePort(t *testing.T) {
+	ls, err := listenReusePort(context.Background(), "tcp", "127.0.0.1:0", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ls[0].Addr().String()
+	if got := ls[1].Addr().String(); got != addr {
+		t.Fatalf("want listeners on %s, but got %s", addr, got)
+	}
+	counted := []*countingListener{{Listener: ls[0]}, {Listener: ls[1]}}
+
+	s := New(&Config{ErrorLog: log.New(ioutil.Discard, "", 0)})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.serveListeners([]net.Listener{counted[0], counted[1]})
+	}()
+
+	// the kernel distributes connections by hash, so both listeners get
+	// some of them sooner or later.
+	for i := 0; i < 1000; i++ {
+		if atomic.LoadInt32(&counted[0].accepted) > 0 && atomic.LoadInt32(&counted[1].accepted) > 0 {
+			break
+		}
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		time.Sleep(time.Millisecond)
+	}
+	for i, l := range counted {
+		if atomic.LoadInt32(&l.accepted) == 0 {
+			t.Errorf("listener %d accepted no connection", i)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errCh:
+		if err != ErrServerClosed {
+			t.Fatalf("want %v, but got %v", ErrServerClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listeners are not closed by Shutdown")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("want the address to be released")
+	}
+}
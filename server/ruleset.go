@@ -0,0 +1,173 @@
+package server
+
+import (
+	"net"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/Code-Hex/socks5"
+)
+
+// Action represents the decision of a rule.
+type Action int
+
+const (
+	// Deny refuses the request with X'02' connection not allowed by ruleset.
+	Deny Action = iota
+
+	// Allow accepts the request.
+	Allow
+)
+
+// PortRange represents the range of ports From through To inclusive.
+type PortRange struct {
+	From, To int
+}
+
+// Rule matches requests by destination and command. Empty fields match
+// any request.
+type Rule struct {
+	Action Action
+
+	// Hosts is the list of destination patterns. A pattern is either a
+	// CIDR such as "10.0.0.0/8", which matches IP destinations, or a glob
+	// such as "*.example.com", which is matched case-insensitively against
+	// the host as sent by the client.
+	Hosts []string
+
+	// HostRegexps is the list of patterns matched against the host as sent
+	// by the client. A rule matches the host if any of Hosts or HostRegexps
+	// does. Since each of them is evaluated for every request until a rule
+	// matches, prefer Hosts and keep the number of regexps small on busy
+	// servers.
+	HostRegexps []*regexp.Regexp
+
+	// Ports is the list of destination port ranges.
+	Ports []PortRange
+
+	// Commands is the list of commands.
+	Commands []socks5.Command
+}
+
+// RuleSet evaluates rules in order and the first matching rule decides
+// the request. It must not be modified while the server is running.
+type RuleSet struct {
+	Rules []Rule
+
+	// Default is the action when no rule matches.
+	Default Action
+}
+
+// Allow reports whether the request for host and port with cmd is allowed.
+func (rs *RuleSet) Allow(host string, port int, cmd socks5.Command) bool {
+	for i := range rs.Rules {
+		if rs.Rules[i].match(host, port, cmd) {
+			return rs.Rules[i].Action == Allow
+		}
+	}
+	return rs.Default == Allow
+}
+
+// allowResolved is like Allow, but a rule matches if its hosts match
+// either host or ip, which is an address of host.
+func (rs *RuleSet) allowResolved(host string, ip net.IP, port int, cmd socks5.Command) bool {
+	for i := range rs.Rules {
+		r := &rs.Rules[i]
+		if (r.matchHost(host) || r.matchHost(ip.String())) && r.matchPort(port) && r.matchCommand(cmd) {
+			return r.Action == Allow
+		}
+	}
+	return rs.Default == Allow
+}
+
+func (r *Rule) match(host string, port int, cmd socks5.Command) bool {
+	return r.matchHost(host) && r.matchPort(port) && r.matchCommand(cmd)
+}
+
+func (r *Rule) matchHost(host string) bool {
+	if len(r.Hosts) == 0 && len(r.HostRegexps) == 0 {
+		return true
+	}
+	for _, re := range r.HostRegexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	ip := net.ParseIP(host)
+	host = strings.ToLower(host)
+	for _, pattern := range r.Hosts {
+		if strings.Contains(pattern, "/") {
+			_, cidr, err := net.ParseCIDR(pattern)
+			if err == nil && ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchPort(port int) bool {
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, pr := range r.Ports {
+		if pr.From <= port && port <= pr.To {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchCommand(cmd socks5.Command) bool {
+	if len(r.Commands) == 0 {
+		return true
+	}
+	for _, c := range r.Commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// domainBlocklist matches domain names against patterns of
+// Config.BlockedDomains.
+type domainBlocklist struct {
+	exact    map[string]bool
+	suffixes []string // such as ".ads.example.com" for "*.ads.example.com"
+}
+
+func newDomainBlocklist(patterns []string) *domainBlocklist {
+	b := &domainBlocklist{exact: make(map[string]bool)}
+	for _, pattern := range patterns {
+		pattern = normalizeDomain(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			b.suffixes = append(b.suffixes, pattern[1:])
+		} else {
+			b.exact[pattern] = true
+		}
+	}
+	return b
+}
+
+func (b *domainBlocklist) blocked(domain string) bool {
+	domain = normalizeDomain(domain)
+	if b.exact[domain] {
+		return true
+	}
+	for _, suffix := range b.suffixes {
+		if strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
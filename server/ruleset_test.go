@@ -0,0 +1,103 @@
+package server
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/Code-Hex/socks5"
+)
+
+func TestRuleSet_Allow(t *testing.T) {
+	rs := &RuleSet{
+		Rules: []Rule{
+			{Action: Deny, Hosts: []string{"10.0.0.0/8", "fd00::/8"}},
+			{Action: Allow, Hosts: []string{"*.Example.com"}, Ports: []PortRange{{443, 443}}},
+			{Action: Allow, Ports: []PortRange{{8000, 8999}}, Commands: []socks5.Command{socks5.CmdConnect}},
+			{Action: Deny, Hosts: []string{"*.example.com"}},
+		},
+		Default: Allow,
+	}
+	cases := []struct {
+		host string
+		port int
+		cmd  socks5.Command
+		want bool
+	}{
+		{"10.1.2.3", 443, socks5.CmdConnect, false},
+		{"fd00::1", 443, socks5.CmdConnect, false},
+		{"www.example.com", 443, socks5.CmdConnect, true},
+		{"WWW.EXAMPLE.COM", 443, socks5.CmdConnect, true},
+		{"www.example.com", 80, socks5.CmdConnect, false},
+		{"www.example.com", 8080, socks5.CmdConnect, true},
+		{"www.example.com", 8080, socks5.CmdBind, false},
+		{"example.org", 80, socks5.CmdConnect, true},
+		{"192.0.2.1", 80, socks5.CmdUDPAssociate, true},
+	}
+	for _, tc := range cases {
+		if got := rs.Allow(tc.host, tc.port, tc.cmd); got != tc.want {
+			t.Errorf("Allow(%q, %d, %s) = %v, want %v", tc.host, tc.port, tc.cmd, got, tc.want)
+		}
+	}
+}
+
+func TestRuleSet_Default(t *testing.T) {
+	rs := &RuleSet{
+		Rules: []Rule{{Action: Allow, Ports: []PortRange{{443, 443}}}},
+	}
+	if !rs.Allow("example.com", 443, socks5.CmdConnect) {
+		t.Fatal("want allowed")
+	}
+	if rs.Allow("example.com", 80, socks5.CmdConnect) {
+		t.Fatal("want denied by default")
+	}
+}
+
+func TestRuleSet_HostRegexps(t *testing.T) {
+	rs := &RuleSet{
+		Rules: []Rule{
+			{Action: Deny, HostRegexps: []*regexp.Regexp{regexp.MustCompile(`^(?i)internal-[0-9]+\.corp\.example$`)}},
+			{Action: Allow, HostRegexps: []*regexp.Regexp{
+				regexp.MustCompile(`\.corp\.example$`),
+				regexp.MustCompile(`^api\.`),
+			}},
+		},
+		Default: Deny,
+	}
+	cases := []struct {
+		host string
+		want bool
+	}{
+		{"internal-1.corp.example", false},
+		{"INTERNAL-42.corp.example", false},
+		{"wiki.corp.example", true},
+		{"api.example.com", true},
+		{"www.example.com", false},
+	}
+	for _, tc := range cases {
+		if got := rs.Allow(tc.host, 443, socks5.CmdConnect); got != tc.want {
+			t.Errorf("Allow(%q) = %v, want %v", tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestDomainBlocklist(t *testing.T) {
+	b := newDomainBlocklist([]string{"tracker.example.net", "*.Ads.Example.com"})
+	cases := []struct {
+		domain string
+		want   bool
+	}{
+		{"tracker.example.net", true},
+		{"TRACKER.example.net.", true},
+		{"www.tracker.example.net", false},
+		{"x.ads.example.com", true},
+		{"a.b.ads.example.com", true},
+		{"ads.example.com", false},
+		{"badads.example.com", false},
+		{"example.com", false},
+	}
+	for _, tc := range cases {
+		if got := b.blocked(tc.domain); got != tc.want {
+			t.Errorf("blocked(%q) = %v, want %v", tc.domain, got, tc.want)
+		}
+	}
+}
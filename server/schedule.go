@@ -0,0 +1,79 @@
+package server
+
+import "time"
+
+// TimeWindow represents a daily period in which the proxy may be used.
+type TimeWindow struct {
+	// Weekdays is the list of days on which the window applies. Empty
+	// means every day.
+	Weekdays []time.Weekday
+
+	// Start and End are offsets from midnight such as 9*time.Hour. If End
+	// is before Start, the window lasts until End on the next day.
+	Start, End time.Duration
+}
+
+// AccessSchedule permits requests only during configured time windows.
+type AccessSchedule struct {
+	// Windows is the schedule which applies to every user.
+	Windows []TimeWindow
+
+	// Users overrides Windows for each authenticated user.
+	Users map[string][]TimeWindow
+
+	// Location is the time zone of windows. The default is time.Local.
+	Location *time.Location
+
+	// Now returns the current time. The default is time.Now.
+	Now func() time.Time
+}
+
+// Allowed reports whether user may send a request now. user is empty if
+// the client has not been identified.
+func (a *AccessSchedule) Allowed(user string) bool {
+	windows, ok := a.Users[user]
+	if !ok {
+		windows = a.Windows
+	}
+	now := time.Now()
+	if a.Now != nil {
+		now = a.Now()
+	}
+	if a.Location != nil {
+		now = now.In(a.Location)
+	}
+	for _, w := range windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *TimeWindow) contains(t time.Time) bool {
+	// use the wall clock, which differs from the time elapsed since
+	// midnight on days when daylight saving time starts or ends.
+	h, m, s := t.Clock()
+	offset := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if w.Start <= w.End {
+		return w.onDay(t.Weekday()) && w.Start <= offset && offset < w.End
+	}
+	// the window wraps midnight.
+	if offset >= w.Start {
+		return w.onDay(t.Weekday())
+	}
+	yesterday := (t.Weekday() + 6) % 7
+	return offset < w.End && w.onDay(yesterday)
+}
+
+func (w *TimeWindow) onDay(day time.Weekday) bool {
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range w.Weekdays {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
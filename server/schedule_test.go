@@ -0,0 +1,76 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessSchedule_DST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	w := TimeWindow{Start: 9 * time.Hour, End: 17 * time.Hour}
+	// daylight saving time starts on 2019-03-10 and ends on 2019-11-03.
+	for _, day := range []struct {
+		month time.Month
+		day   int
+	}{
+		{time.March, 10},
+		{time.November, 3},
+	} {
+		for _, tc := range []struct {
+			hour int
+			want bool
+		}{
+			{8, false},
+			{9, true},
+			{16, true},
+			{17, false},
+		} {
+			now := time.Date(2019, day.month, day.day, tc.hour, 30, 0, 0, loc)
+			if got := w.contains(now); got != tc.want {
+				t.Errorf("%s: want %v, but got %v", now, tc.want, got)
+			}
+		}
+	}
+}
+
+func TestAccessSchedule(t *testing.T) {
+	// 2019-10-14 is Monday.
+	now := time.Date(2019, 10, 14, 8, 59, 0, 0, time.UTC)
+	a := &AccessSchedule{
+		Windows: []TimeWindow{{
+			Weekdays: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+			Start:    9 * time.Hour,
+			End:      17 * time.Hour,
+		}},
+		Users: map[string][]TimeWindow{
+			"night": {{Start: 22 * time.Hour, End: 6 * time.Hour}},
+		},
+		Location: time.UTC,
+		Now:      func() time.Time { return now },
+	}
+
+	steps := []struct {
+		advance time.Duration
+		user    string
+		want    bool
+	}{
+		{0, "", false},                             // Mon 08:59
+		{time.Minute, "", true},                    // Mon 09:00
+		{8*time.Hour - time.Minute, "", true},      // Mon 16:59
+		{time.Minute, "", false},                   // Mon 17:00
+		{5 * time.Hour, "night", true},             // Mon 22:00
+		{8*time.Hour - time.Minute, "night", true}, // Tue 05:59
+		{time.Minute, "night", false},              // Tue 06:00
+		{4 * 24 * time.Hour, "", false},            // Sat 06:00
+		{3 * time.Hour, "", false},                 // Sat 09:00
+	}
+	for i, step := range steps {
+		now = now.Add(step.advance)
+		if got := a.Allowed(step.user); got != step.want {
+			t.Errorf("step %d (%s, user %q): want %v, but got %v", i, now, step.user, step.want, got)
+		}
+	}
+}
@@ -2,17 +2,37 @@ package server
 
 import (
 	"context"
+	"crypto/x509"
 	"errors"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/address"
 	"github.com/Code-Hex/socks5/auth"
+	"golang.org/x/time/rate"
 )
 
 var ErrServerClosed = errors.New("socks5: Server closed")
 
+// ErrClientBanned returns when the client IP has been banned by
+// AuthFailureLimiter.
+var ErrClientBanned = errors.New("socks5: client is banned")
+
+// ErrClientRateLimited returns when the client IP has opened connections
+// faster than ConnRateLimit allows.
+var ErrClientRateLimited = errors.New("socks5: client is rate limited")
+
+// ErrTooManyConns returns when the server already has MaxConns connections.
+var ErrTooManyConns = errors.New("socks5: too many connections")
+
+// ErrClientNotAllowed returns when the client IP is refused by
+// AllowedClients or DeniedClients.
+var ErrClientNotAllowed = errors.New("socks5: client is not allowed")
+
 type Config struct {
 	AuthMethods map[auth.Method]auth.Authenticator
 
@@ -20,8 +40,355 @@ type Config struct {
 	DialContext  func(ctx context.Context, network, address string) (net.Conn, error)
 	Listen       func(ctx context.Context, network, address string) (net.Listener, error)
 	ListenPacket func(ctx context.Context, network, address string) (net.PacketConn, error)
+
+	// MethodPreference is the order in which the server prefers methods
+	// when the client offers several acceptable ones. Methods missing from
+	// AuthMethods are ignored. If empty, registered methods are preferred
+	// in ascending order of their code, except that auth.MethodNotRequired
+	// comes last.
+	MethodPreference []auth.Method
+
+	// SelectMethod, if non-nil, is a policy to choose the method from
+	// candidates, which are the methods supported by both the client and
+	// the server in order of MethodPreference. It can decide based on the
+	// client, e.g. allowing auth.MethodNotRequired only from trusted
+	// networks. Reporting false or returning a method which is not a
+	// candidate means none of the methods are acceptable. If nil, the
+	// first candidate is selected.
+	SelectMethod func(conn net.Conn, candidates []auth.Method) (auth.Method, bool)
+
+	// RequireAuth prevents the server from selecting auth.MethodNotRequired
+	// even if it is registered in AuthMethods.
+	RequireAuth bool
+
+	// ClientCertMapper, if non-nil, maps the certificate presented by a
+	// client connected over TLS to the user. If it reports true and the
+	// client offers auth.MethodNotRequired, the client is authenticated as
+	// the user without in-band SOCKS authentication. Verification of the
+	// certificate is left to the tls.Config of the listener.
+	ClientCertMapper func(cert *x509.Certificate) (user string, ok bool)
+
+	// AllowedCommands is the list of commands which the server accepts.
+	// Others are replied with X'07' command not supported. The default
+	// allows CONNECT, BIND and UDP ASSOCIATE.
+	AllowedCommands []socks5.Command
+
+	// LocalIP, if non-nil, is the source IP of outbound connections and
+	// datagrams made by the default DialContext.
+	LocalIP net.IP
+
+	// SelectLocalIP, if non-nil, overrides LocalIP for each outbound
+	// connection. Returning nil lets the system choose the source IP.
+	SelectLocalIP func(ctx context.Context, network, address string) net.IP
+
+	// ResolveBeforeDial makes the server resolve destination domain names
+	// of CONNECT and UDP ASSOCIATE itself and call DialContext with the
+	// resolved IPs, to which IP-based policies apply. For CONNECT, rules of
+	// RuleSet and UserRules then match if their hosts match either the
+	// domain name or a resolved IP, so that a rule such as denying
+	// "10.0.0.0/8" cannot be bypassed with a domain name.
+	ResolveBeforeDial bool
+
+	// Resolver, if non-nil, resolves destination domain names of CONNECT
+	// and UDP ASSOCIATE, and DialContext is called with the resolved IPs.
+	// If nil, net.DefaultResolver is used where the server resolves names.
+	Resolver Resolver
+
+	// ResolveFunc, if non-nil, returns the IPs of a destination domain
+	// name, such as from service discovery. It takes precedence over
+	// Resolver and makes the server resolve domain destinations of CONNECT
+	// and UDP ASSOCIATE. Returning no IPs without an error is replied with
+	// X'04' Host unreachable.
+	ResolveFunc func(ctx context.Context, host string) ([]net.IP, error)
+
+	// ResolveTimeout, if positive, is the maximum duration of resolving a
+	// destination domain name by the server. A request whose resolution
+	// times out is replied with X'04' Host unreachable.
+	ResolveTimeout time.Duration
+
+	// DialTimeout, if positive, is the maximum duration of dialing each
+	// address of the destination. An expired dial is replied with X'06' TTL
+	// expired. Zero means no timeout other than that of the OS.
+	DialTimeout time.Duration
+
+	// DialRetries is the number of times a failed dial to an address of the
+	// destination is retried, such as while the destination is restarting.
+	// The first retry waits for DialRetryDelay, which doubles on each
+	// retry. The default delay is 100ms. Retries stop when the request is
+	// canceled.
+	DialRetries    int
+	DialRetryDelay time.Duration
+
+	// AddressFamily restricts the IP version used for domain destinations
+	// of CONNECT and UDP ASSOCIATE. Unless it is AddressFamilyAuto, names
+	// are resolved by the server and a name without an address of the
+	// family is replied with X'04' Host unreachable.
+	AddressFamily AddressFamily
+
+	// DNSCacheTTL, if positive, caches domain lookups made by the server
+	// for the duration, and makes the server resolve domain destinations
+	// of CONNECT and UDP ASSOCIATE. Failed lookups are cached for at most
+	// 5 seconds.
+	DNSCacheTTL time.Duration
+
+	// DNSCacheSize is the maximum number of cached domains. The least
+	// recently used domain is evicted first. The default is 1024.
+	DNSCacheSize int
+
+	// HappyEyeballs makes CONNECT to a domain with both IPv4 and IPv6
+	// addresses dial the family of the first address, then the other one
+	// 300ms later if no connection has been established (RFC 8305). The
+	// first connection established is used. Domain names are resolved by
+	// the server in that case.
+	HappyEyeballs bool
+
+	// GeoIPPolicy, if non-nil, reports whether ip may be used, such as by
+	// looking up its country in a GeoIP database. It is called for the
+	// client IP when a connection is accepted, and for destination IPs
+	// before dialing; domain names are resolved by the server in that case.
+	// Denied clients are closed and denied destinations are replied with
+	// X'02' connection not allowed by ruleset.
+	GeoIPPolicy func(ip net.IP) (allow bool)
+
+	// DenyPrivateNetworks refuses CONNECT and UDP destinations in private,
+	// loopback and link-local networks with X'02' connection not allowed
+	// by ruleset. Domain names are resolved by the server and checked
+	// against the resolved IPs.
+	DenyPrivateNetworks bool
+
+	// AccessSchedule, if non-nil, refuses requests outside of its time
+	// windows with X'02' connection not allowed by ruleset.
+	AccessSchedule *AccessSchedule
+
+	// BlockedDomains is the list of domain names which clients may not
+	// connect to. A pattern such as "*.ads.example.com" matches any
+	// subdomain. Matching is case-insensitive and applies to destinations
+	// sent as domain names: CONNECT requests and datagrams of UDP
+	// ASSOCIATE, which are dropped.
+	BlockedDomains []string
+
+	// AllowedPorts, if non-empty, is the list of destination port ranges
+	// which clients may use. CONNECT and BIND requests for other ports are
+	// refused with X'02' connection not allowed by ruleset and datagrams of
+	// UDP ASSOCIATE to other ports are dropped.
+	AllowedPorts []PortRange
+
+	// RuleSet, if non-nil, decides which destinations may be requested.
+	RuleSet *RuleSet
+
+	// UserRules is the rule set for each authenticated user. Users without
+	// an entry fall back to RuleSet.
+	UserRules map[string]*RuleSet
+
+	// Authorize, if non-nil, is called for every request after the static
+	// policies above have allowed it. user is empty if the client has not
+	// been identified. Returning an error refuses the request with X'02'
+	// connection not allowed by ruleset.
+	Authorize func(ctx context.Context, user string, cmd socks5.Command, dst *address.Info) error
+
+	// RequestFilter, if non-nil, is called for every request after
+	// Authorize. If it denies the request, the client receives status as
+	// the reply, or X'02' connection not allowed by ruleset if status is
+	// socks5.StatusSucceeded.
+	RequestFilter func(req *Request) (allow bool, status socks5.Reply)
+
+	// AdvertisedAddr is the host reported in BND.ADDR of replies instead of
+	// the local address, such as the public address of the server behind
+	// NAT. BND.PORT is left as the local port. It may be an IP or FQDN.
+	AdvertisedAddr string
+
+	// AllowAnyUDPSource disables the check that datagrams of UDP ASSOCIATE
+	// come from the client's address, so that the relay can be used by
+	// multiple sources.
+	AllowAnyUDPSource bool
+
+	// BindTimeout is how long BIND waits for the inbound connection from
+	// the peer. The default is 2 minutes.
+	BindTimeout time.Duration
+
+	// BufferSize is the size of buffers to relay CONNECT and BIND when the
+	// kernel cannot copy between the connections directly, such as when
+	// they are encrypted or throttled. The default is 32 KiB.
+	BufferSize int
+
+	// DisableNoDelay, if true, enables Nagle's algorithm on the client and
+	// target connections of CONNECT and BIND so that small writes of bulk
+	// transfers are coalesced. By default, TCP_NODELAY is set on them for
+	// the latency of interactive protocols such as SSH.
+	DisableNoDelay bool
+
+	// KeepAlive specifies the interval between TCP keep-alive probes on the
+	// client and target connections of CONNECT and BIND, which detects
+	// peers gone behind NAT. If negative, keep-alives are disabled. Zero
+	// leaves the connections as they are accepted and dialed.
+	KeepAlive time.Duration
+
+	// UDPBufferSize is the size of the buffer to read a datagram of UDP
+	// ASSOCIATE. Larger datagrams are dropped. The default is 64 KiB.
+	UDPBufferSize int
+
+	// UDPRewrite, if non-nil, is called with the payload of each datagram
+	// relayed by UDP ASSOCIATE and returns the payload to send instead.
+	// Returning nil drops the datagram. For Outbound, src is the client and
+	// dst is the destination requested in the header; for Inbound, they are
+	// the other way around. It may be called concurrently.
+	UDPRewrite func(dir Direction, src, dst net.Addr, payload []byte) []byte
+
+	// UDPIdleTimeout is the duration after which a UDP association is
+	// closed if no datagrams have been relayed. Zero means no timeout; the
+	// association lasts as long as its control connection.
+	UDPIdleTimeout time.Duration
+
+	// IdleTimeout, if positive, is the duration after which a relay of
+	// CONNECT or BIND is closed when no data has been transferred in either
+	// direction, such as when the peer has gone behind NAT. It prevents the
+	// kernel from splicing the connections.
+	IdleTimeout time.Duration
+
+	// RelayTimeout, if positive, is the maximum duration of a relay of
+	// CONNECT or BIND. Both connections are closed when it expires even if
+	// data is being transferred, which caps the length of sessions.
+	RelayTimeout time.Duration
+
+	// MaxBytesPerConn, if positive, is the number of bytes which a relay of
+	// CONNECT or BIND may transfer in both directions in total. The
+	// connections are closed when it is reached. It prevents the kernel
+	// from splicing the connections.
+	MaxBytesPerConn int64
+
+	// MaxWorkers, if positive, is the number of goroutines which serve
+	// connections accepted by Serve, instead of a goroutine per connection.
+	// The workers are shared by all the listeners. Since a worker serves a
+	// connection until it is closed, at most MaxWorkers connections are
+	// served at once, and Serve stops accepting while all of them are busy.
+	MaxWorkers int
+
+	// AcceptRetryDelay is how long Serve sleeps after a temporary Accept
+	// error, which doubles on consecutive errors up to MaxAcceptRetryDelay.
+	// The defaults are 5ms and 1s.
+	AcceptRetryDelay    time.Duration
+	MaxAcceptRetryDelay time.Duration
+
+	// HandshakeTimeout is the maximum duration for method negotiation,
+	// authentication and reading the request. Zero means no timeout.
+	HandshakeTimeout time.Duration
+
+	// RequestReadTimeout is the maximum duration for reading the request
+	// after authentication, which drops clients stalling before sending
+	// the request. HandshakeTimeout still applies if it expires earlier.
+	// Zero means no timeout.
+	RequestReadTimeout time.Duration
+
+	// MaxRequestDuration, if positive, is the maximum duration from
+	// accepting a connection until the relay starts, which covers
+	// authentication, reading the request and dialing the destination
+	// regardless of the timeouts of each phase. A dial exceeding it is
+	// replied with X'06' TTL expired.
+	MaxRequestDuration time.Duration
+
+	// MaxConnDuration, if positive, is the maximum age of a connection.
+	// The connection is closed when it expires in any phase, including
+	// authentication and relaying, even if data is being transferred.
+	MaxConnDuration time.Duration
+
+	// OnAuth, if non-nil, is called after every authentication attempt
+	// with the selected method, the user reported by the authenticator and
+	// the error if it failed. method is auth.MethodNoAcceptableMethods if
+	// negotiation failed before a method was selected. It is called on the
+	// connection's goroutine, so it should return quickly.
+	OnAuth func(remoteAddr net.Addr, method auth.Method, user string, err error)
+
+	// UserQuota, if non-nil, limits connections and bandwidth of each
+	// authenticated user.
+	UserQuota UserQuota
+
+	// RateLimit, if non-nil, limits the bandwidth of each direction of
+	// every CONNECT and BIND relay.
+	RateLimit *RateLimit
+
+	// GlobalRateLimit, if non-nil, limits the aggregate bandwidth of all
+	// CONNECT and BIND relays of the server in both directions.
+	GlobalRateLimit *RateLimit
+
+	// AllowedClients, if non-empty, is the list of networks which clients
+	// may connect from. Connections from others are closed before the
+	// handshake.
+	AllowedClients []*net.IPNet
+
+	// DeniedClients is the list of networks which clients may not connect
+	// from. It takes precedence over AllowedClients.
+	DeniedClients []*net.IPNet
+
+	// MaxConns is the maximum number of concurrent connections. Accepted
+	// connections over the limit are closed. Zero means no limit.
+	MaxConns int
+
+	// MaxConnsPerClient is the maximum number of concurrent connections
+	// from each client IP. Zero means no limit.
+	MaxConnsPerClient int
+
+	// ConnRateLimit, if non-nil, closes connections from client IPs which
+	// open new connections too fast.
+	ConnRateLimit *ConnRateLimiter
+
+	// AuthFailureLimiter, if non-nil, refuses clients which repeatedly
+	// fail to authenticate.
+	AuthFailureLimiter *AuthFailureLimiter
+
+	// Logger, if non-nil, receives the diagnostics of the server. If nil,
+	// errors and info messages, such as the end of each connection, are
+	// written to ErrorLog.
+	Logger Logger
+
+	// ErrorLog specifies an optional logger for errors when Logger is nil.
+	// If nil, logging is done via the log package's standard logger.
+	ErrorLog *log.Logger
+
+	// ConnState, if non-nil, is called when a client connection changes
+	// state. See the ConnState type for details. conn is the accepted
+	// connection even if an authentication method wraps it.
+	ConnState func(conn net.Conn, state ConnState)
+
+	// OnConnect, if non-nil, is called with each accepted connection
+	// before it is served. ctx holds the ID of the connection, which
+	// ConnIDFromContext returns.
+	OnConnect func(ctx context.Context, conn net.Conn)
+
+	// OnClose, if non-nil, is called when the server has finished serving
+	// the connection, which has been closed, with the error which ended
+	// it. err is nil if the request completed successfully.
+	OnClose func(ctx context.Context, conn net.Conn, err error)
+
+	// Debug makes the server log the bytes of method negotiation,
+	// authentication, the request and replies exchanged with clients as
+	// debug messages of Logger, or with ErrorLog if Logger is nil. Relayed
+	// data is not logged, but credentials such as passwords are, so it must
+	// be enabled only for diagnosis.
+	Debug bool
+
+	// Tracer, if non-nil, starts a span for each request, which records
+	// the command, destination, reply code and duration of the request.
+	Tracer Tracer
+
+	// AccessLog, if non-nil, is called with the record of each request
+	// when it completes, whether it has succeeded or not.
+	AccessLog func(rec *AccessRecord)
+
+	// OnTransfer, if non-nil, is called when the relay of a request has
+	// finished with the number of bytes relayed from the client to the
+	// destination (up) and the other way around (down).
+	OnTransfer func(up, down int64)
 }
 
+const (
+	defaultBindTimeout         = 2 * time.Minute
+	defaultUDPBufferSize       = 64 * 1024
+	defaultBufferSize          = 32 * 1024 // the same as io.Copy
+	defaultAcceptRetryDelay    = 5 * time.Millisecond
+	defaultMaxAcceptRetryDelay = time.Second
+	defaultDialRetryDelay      = 100 * time.Millisecond
+)
+
 func New(c *Config) *Socks5 {
 	if c == nil {
 		c = &Config{}
@@ -34,6 +401,9 @@ func New(c *Config) *Socks5 {
 	if c.DialContext == nil {
 		c.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
 			var d net.Dialer
+			if ip := c.localIP(ctx, network, address); ip != nil {
+				d.LocalAddr = localAddr(network, ip)
+			}
 			return d.DialContext(ctx, network, address)
 		}
 	}
@@ -49,21 +419,99 @@ func New(c *Config) *Socks5 {
 			return l.ListenPacket(ctx, network, address)
 		}
 	}
+	if len(c.AllowedCommands) == 0 {
+		c.AllowedCommands = []socks5.Command{
+			socks5.CmdConnect,
+			socks5.CmdBind,
+			socks5.CmdUDPAssociate,
+		}
+	}
+	if c.BindTimeout <= 0 {
+		c.BindTimeout = defaultBindTimeout
+	}
+	if c.UDPBufferSize <= 0 {
+		c.UDPBufferSize = defaultUDPBufferSize
+	}
+	if c.BufferSize <= 0 {
+		c.BufferSize = defaultBufferSize
+	}
+	if c.DialRetryDelay <= 0 {
+		c.DialRetryDelay = defaultDialRetryDelay
+	}
+	if c.AcceptRetryDelay <= 0 {
+		c.AcceptRetryDelay = defaultAcceptRetryDelay
+	}
+	if c.MaxAcceptRetryDelay <= 0 {
+		c.MaxAcceptRetryDelay = defaultMaxAcceptRetryDelay
+	}
+	var cache *dnsCache
+	if c.DNSCacheTTL > 0 {
+		cache = newDNSCache(c.DNSCacheTTL, c.DNSCacheSize)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Socks5{
-		config:      c,
-		shutdown:    make(chan struct{}),
-		waitingDone: make(chan struct{}),
+		config:        c,
+		blocklist:     newDomainBlocklist(c.BlockedDomains),
+		dnsCache:      cache,
+		buffers:       newBufferPool(c.BufferSize),
+		globalLimiter: c.GlobalRateLimit.newLimiter(),
+		ctx:           ctx,
+		cancel:        cancel,
+		shutdown:      make(chan struct{}),
+		waitingDone:   make(chan struct{}),
 	}
 }
 
 type Socks5 struct {
-	config *Config
+	// accessed atomically, so 64-bit aligned first.
+	connIDs      uint64 // last connection ID
+	acceptErrors uint64 // number of temporary Accept errors
+
+	config    *Config
+	blocklist *domainBlocklist
+	dnsCache  *dnsCache // nil unless Config.DNSCacheTTL is positive
+	buffers   *bufferPool
+
+	globalLimiter *rate.Limiter // nil unless Config.GlobalRateLimit is set
+
+	onceWorkers sync.Once
+	work        chan net.Conn // nil unless Config.MaxWorkers is positive
+
+	// ctx is the base context of every connection.
+	// It is canceled when shutdown has been started.
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	onceShutdown sync.Once
 	shutdown     chan struct{}
 	waitingDone  chan struct{}
 
-	wg sync.WaitGroup
+	listenersMu sync.Mutex
+	listeners   map[*net.Listener]struct{} // closed by Shutdown
+
+	activeConnsMu sync.Mutex
+	activeConns   map[*net.Conn]struct{} // closed by Close
+	closed        bool                   // connections have been closed by Close or Shutdown
+
+	onShutdownMu sync.Mutex
+	onShutdown   []func()
+
+	wg    sync.WaitGroup
+	conns int32 // number of active connections; accessed atomically
+
+	clientConnsMu sync.Mutex
+	clientConns   map[string]int // number of active connections per IP
+}
+
+// ActiveConns returns the number of connections being served.
+func (s *Socks5) ActiveConns() int {
+	return int(atomic.LoadInt32(&s.conns))
+}
+
+// AcceptErrors returns the number of temporary errors returned by Accept
+// of the listeners, such as when the process runs out of file descriptors.
+func (s *Socks5) AcceptErrors() uint64 {
+	return atomic.LoadUint64(&s.acceptErrors)
 }
 
 // ListenAndServe is used to create a listener and serve on it
@@ -75,16 +523,13 @@ func (s *Socks5) ListenAndServe(network, addr string) error {
 	return s.Serve(l)
 }
 
-// Serve is used to serve connections from a listener
+// Serve is used to serve connections from a listener. The listener is
+// closed when Shutdown is called.
 func (s *Socks5) Serve(l net.Listener) error {
-	ctx := context.Background()
+	s.trackListener(&l, true)
+	defer s.trackListener(&l, false)
 
-	// for udp associate
-	udpConn, err := s.config.ListenPacket(ctx, "udp", "0.0.0.0:0")
-	if err != nil {
-		return err
-	}
-	defer udpConn.Close()
+	work := s.startWorkers()
 
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
@@ -96,16 +541,22 @@ func (s *Socks5) Serve(l net.Listener) error {
 
 		conn, err := l.Accept()
 		if err != nil {
+			select {
+			case <-s.shutdown:
+				return ErrServerClosed
+			default:
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				atomic.AddUint64(&s.acceptErrors, 1)
 				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
+					tempDelay = s.config.AcceptRetryDelay
 				} else {
 					tempDelay *= 2
 				}
-				if max := time.Second; tempDelay > max {
+				if max := s.config.MaxAcceptRetryDelay; tempDelay > max {
 					tempDelay = max
 				}
-				log.Printf("socks5: Accept error: %v; retrying in %v", err, tempDelay)
+				s.logger().Errorf("socks5: Accept error: %v; retrying in %v", err, tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
@@ -113,47 +564,409 @@ func (s *Socks5) Serve(l net.Listener) error {
 		}
 		tempDelay = 0
 
-		udpConn := udpConn // To avoid race condition
-		go func() {
-			if err := s.serveConn(ctx, conn, udpConn); err != nil {
-				log.Printf("socks5: error(tcp) %v", err)
-			}
-			log.Println("done tcp serve")
-		}()
+		// count the connection before serving it so that Shutdown never
+		// misses it.
+		if !s.addConn() {
+			conn.Close()
+			return ErrServerClosed
+		}
+		if work == nil {
+			go s.handleConn(conn)
+			continue
+		}
+		// wait for an idle worker, which stops accepting new connections.
+		select {
+		case work <- conn:
+		case <-s.shutdown:
+			conn.Close()
+			s.wg.Done()
+			return ErrServerClosed
+		}
+	}
+}
+
+// startWorkers starts the workers of Config.MaxWorkers once and returns
+// the channel to hand connections to them. The workers exit when shutdown
+// has been started.
+func (s *Socks5) startWorkers() chan<- net.Conn {
+	s.onceWorkers.Do(func() {
+		n := s.config.MaxWorkers
+		if n <= 0 {
+			return
+		}
+		s.work = make(chan net.Conn)
+		for i := 0; i < n; i++ {
+			go func() {
+				for {
+					select {
+					case conn := <-s.work:
+						s.handleConn(conn)
+					case <-s.shutdown:
+						return
+					}
+				}
+			}()
+		}
+	})
+	return s.work
+}
+
+func (s *Socks5) trackListener(l *net.Listener, add bool) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[*net.Listener]struct{})
+	}
+	if add {
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+}
+
+func (s *Socks5) closeListeners() error {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	var err error
+	for l := range s.listeners {
+		if cerr := (*l).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, l)
+	}
+	return err
+}
+
+// trackConn registers conn as being served, or closes it if Close has
+// already been called.
+func (s *Socks5) trackConn(conn *net.Conn, add bool) {
+	s.activeConnsMu.Lock()
+	defer s.activeConnsMu.Unlock()
+	if s.activeConns == nil {
+		s.activeConns = make(map[*net.Conn]struct{})
+	}
+	if !add {
+		delete(s.activeConns, conn)
+		return
+	}
+	if s.closed {
+		(*conn).Close()
+		return
+	}
+	s.activeConns[conn] = struct{}{}
+}
+
+// addConn counts an accepted connection for Shutdown to wait for. It
+// reports false if shutdown has been started.
+func (s *Socks5) addConn() bool {
+	s.activeConnsMu.Lock()
+	defer s.activeConnsMu.Unlock()
+	select {
+	case <-s.shutdown:
+		return false
+	default:
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// handleConn serves conn counted by addConn.
+func (s *Socks5) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+	id := atomic.AddUint64(&s.connIDs, 1)
+	ctx := withConnID(s.ctx, id)
+	if onConnect := s.config.OnConnect; onConnect != nil {
+		onConnect(ctx, conn)
+	}
+	err := s.serveConn(ctx, conn)
+	if onClose := s.config.OnClose; onClose != nil {
+		onClose(ctx, conn, err)
 	}
+	if err != nil {
+		s.logger().Errorf("socks5: error(tcp) conn %d: %v", id, err)
+		return
+	}
+	s.logger().Infof("socks5: done tcp serve conn %d from %s", id, conn.RemoteAddr())
 }
 
+func (s *Socks5) logger() Logger {
+	if s.config.Logger != nil {
+		return s.config.Logger
+	}
+	return stdLogger{l: s.config.ErrorLog, debug: s.config.Debug}
+}
+
+// Shutdown gracefully shuts down the server. It closes the listeners so
+// that Serve returns ErrServerClosed at once, cancels the context of the
+// connections and waits for them to finish. If ctx is done first, the
+// remaining connections are closed as by Close and ctx.Err() is returned.
 func (s *Socks5) Shutdown(ctx context.Context) error {
+	s.startShutdown()
+	select {
+	case <-ctx.Done():
+		s.closeConns()
+		return ctx.Err()
+	case <-s.waitingDone:
+	}
+	return nil
+}
+
+// Close immediately closes the listeners and all the connections being
+// served, without waiting for relays to finish. It returns the error of
+// closing the listeners, if any. Use Shutdown to shut down gracefully.
+func (s *Socks5) Close() error {
+	err := s.startShutdown()
+	s.closeConns()
+	return err
+}
+
+// closeConns closes the connections being served and those which will be
+// tracked afterwards.
+func (s *Socks5) closeConns() {
+	s.activeConnsMu.Lock()
+	defer s.activeConnsMu.Unlock()
+	s.closed = true
+	for conn := range s.activeConns {
+		(*conn).Close()
+	}
+}
+
+// RegisterOnShutdown registers a function to call in a new goroutine when
+// Shutdown or Close is called, such as to release resources used by hooks.
+func (s *Socks5) RegisterOnShutdown(f func()) {
+	s.onShutdownMu.Lock()
+	s.onShutdown = append(s.onShutdown, f)
+	s.onShutdownMu.Unlock()
+}
+
+// startShutdown starts shutting down once and returns the error of closing
+// the listeners.
+func (s *Socks5) startShutdown() error {
+	var err error
 	s.onceShutdown.Do(func() {
+		// no connection is counted by addConn after this.
+		s.activeConnsMu.Lock()
 		close(s.shutdown)
+		s.activeConnsMu.Unlock()
+
+		s.onShutdownMu.Lock()
+		for _, f := range s.onShutdown {
+			go f()
+		}
+		s.onShutdownMu.Unlock()
+		err = s.closeListeners()
+		s.cancel()
 		go func() {
 			s.wg.Wait()
 			close(s.waitingDone)
 		}()
 	})
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-s.waitingDone:
-	}
-	return nil
+	return err
 }
 
-func (s *Socks5) serveConn(ctx context.Context, conn net.Conn, udpConn net.PacketConn) error {
-	s.wg.Add(1)
+func (s *Socks5) serveConn(ctx context.Context, conn net.Conn) error {
+	accepted := conn
+	s.setState(accepted, StateNew)
+	s.trackConn(&accepted, true)
 	defer func() {
-		s.wg.Done()
 		conn.Close()
+		s.trackConn(&accepted, false)
+		s.setState(accepted, StateClosed)
 	}()
+	if d := s.config.MaxConnDuration; d > 0 {
+		// the context stops dialing and relaying, and closing the
+		// connection stops the other phases.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+		timer := time.AfterFunc(d, func() { accepted.Close() })
+		defer timer.Stop()
+	}
 
-	if err := s.authenticate(conn); err != nil {
-		return err
+	n := atomic.AddInt32(&s.conns, 1)
+	defer atomic.AddInt32(&s.conns, -1)
+	if max := s.config.MaxConns; max > 0 && int(n) > max {
+		return ErrTooManyConns
+	}
+
+	ip := remoteIP(conn)
+	if !s.clientAllowed(ip) {
+		return ErrClientNotAllowed
+	}
+	if policy := s.config.GeoIPPolicy; policy != nil && ip != nil && !policy(ip) {
+		return ErrClientNotAllowed
+	}
+	if l := s.config.ConnRateLimit; l != nil && !l.Allow(ip) {
+		return ErrClientRateLimited
+	}
+	if s.config.MaxConnsPerClient > 0 {
+		if !s.acquireClient(ip) {
+			return ErrTooManyConns
+		}
+		defer s.releaseClient(ip)
+	}
+	limiter := s.config.AuthFailureLimiter
+	if limiter != nil && limiter.Banned(ip) {
+		return ErrClientBanned
 	}
 
-	req, err := s.newRequest(conn, udpConn)
+	var debug *debugConn
+	if s.config.Debug {
+		id, _ := ConnIDFromContext(ctx)
+		debug = &debugConn{Conn: conn, logger: s.logger(), id: id}
+		conn = debug
+	}
+	var budget, handshakeDeadline time.Time
+	if d := s.config.MaxRequestDuration; d > 0 {
+		budget = time.Now().Add(d)
+		handshakeDeadline = budget
+	}
+	if d := s.config.HandshakeTimeout; d > 0 {
+		if deadline := time.Now().Add(d); handshakeDeadline.IsZero() || deadline.Before(handshakeDeadline) {
+			handshakeDeadline = deadline
+		}
+	}
+	if !handshakeDeadline.IsZero() {
+		conn.SetDeadline(handshakeDeadline)
+	}
+	authStart := time.Now()
+	result, err := s.authenticateBefore(ctx, conn, budget)
+	authDuration := time.Since(authStart)
+	if err != nil {
+		if limiter != nil && errors.Is(err, auth.ErrAuthenticationFailed) {
+			limiter.Fail(ip)
+		}
+		return err
+	}
+	s.setState(accepted, StateActive)
+	if result != nil && result.User != "" {
+		ctx = withUser(ctx, result.User)
+	}
+	if result != nil && result.Conn != nil {
+		defer result.Conn.Close()
+		conn = result.Conn
+	}
+	if timeout := s.config.RequestReadTimeout; timeout > 0 {
+		deadline := time.Now().Add(timeout)
+		if !handshakeDeadline.IsZero() && handshakeDeadline.Before(deadline) {
+			deadline = handshakeDeadline
+		}
+		conn.SetReadDeadline(deadline)
+	}
+	req, err := s.newRequest(conn)
 	if err != nil {
+		if errors.Is(err, ErrAddressNotSupported) {
+			reply(conn, socks5.StatusAddrTypeNotSupported, nil)
+		}
 		return err
 	}
+	if !handshakeDeadline.IsZero() || s.config.RequestReadTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	req.conn = accepted
+	req.debug = debug
+	req.timing.auth = authDuration
+	req.deadline = budget
 
 	return req.do(ctx, conn)
 }
+
+// authenticateBefore authenticates the client with the context which
+// expires at deadline unless it is zero.
+func (s *Socks5) authenticateBefore(ctx context.Context, conn net.Conn, deadline time.Time) (*auth.Result, error) {
+	if deadline.IsZero() {
+		return s.authenticate(ctx, conn)
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	return s.authenticate(ctx, conn)
+}
+
+func (c *Config) localIP(ctx context.Context, network, address string) net.IP {
+	if c.SelectLocalIP != nil {
+		return c.SelectLocalIP(ctx, network, address)
+	}
+	return c.LocalIP
+}
+
+func localAddr(network string, ip net.IP) net.Addr {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return &net.UDPAddr{IP: ip}
+	}
+	return &net.TCPAddr{IP: ip}
+}
+
+func (s *Socks5) acquireClient(ip net.IP) bool {
+	s.clientConnsMu.Lock()
+	defer s.clientConnsMu.Unlock()
+	key := ip.String()
+	if s.clientConns[key] >= s.config.MaxConnsPerClient {
+		return false
+	}
+	if s.clientConns == nil {
+		s.clientConns = make(map[string]int)
+	}
+	s.clientConns[key]++
+	return true
+}
+
+func (s *Socks5) releaseClient(ip net.IP) {
+	s.clientConnsMu.Lock()
+	defer s.clientConnsMu.Unlock()
+	key := ip.String()
+	if s.clientConns[key]--; s.clientConns[key] <= 0 {
+		delete(s.clientConns, key)
+	}
+}
+
+func (s *Socks5) clientAllowed(ip net.IP) bool {
+	if ip == nil {
+		return len(s.config.AllowedClients) == 0 && len(s.config.DeniedClients) == 0
+	}
+	if containsIP(s.config.DeniedClients, ip) {
+		return false
+	}
+	return len(s.config.AllowedClients) == 0 || containsIP(s.config.AllowedClients, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Socks5) portAllowed(port int) bool {
+	if len(s.config.AllowedPorts) == 0 {
+		return true
+	}
+	for _, pr := range s.config.AllowedPorts {
+		if pr.From <= port && port <= pr.To {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Socks5) commandAllowed(cmd socks5.Command) bool {
+	for _, allowed := range s.config.AllowedCommands {
+		if cmd == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,41 @@
+package server
+
+import "net"
+
+// ConnState represents the state of a client connection. It is used by
+// the optional Config.ConnState hook.
+type ConnState int
+
+const (
+	// StateNew represents a new connection which has been accepted.
+	StateNew ConnState = iota
+
+	// StateActive represents a connection which has been authenticated
+	// and is sending the request.
+	StateActive
+
+	// StateRelaying represents a connection whose request has succeeded
+	// and whose traffic is being relayed.
+	StateRelaying
+
+	// StateClosed represents a closed connection. It is the terminal
+	// state, which every connection reaches.
+	StateClosed
+)
+
+var stateName = map[ConnState]string{
+	StateNew:      "new",
+	StateActive:   "active",
+	StateRelaying: "relaying",
+	StateClosed:   "closed",
+}
+
+func (c ConnState) String() string {
+	return stateName[c]
+}
+
+func (s *Socks5) setState(conn net.Conn, state ConnState) {
+	if hook := s.config.ConnState; hook != nil {
+		hook(conn, state)
+	}
+}
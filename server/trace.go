@@ -0,0 +1,39 @@
+package server
+
+import "context"
+
+// Tracer creates spans for requests, such as by adapting an OpenTelemetry
+// tracer.
+type Tracer interface {
+	// Start starts a span named name as a child of any span in ctx, and
+	// returns a context holding the new span. The context is passed to
+	// the DialContext of the request.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span represents the work of a request started by Tracer.
+type Span interface {
+	// SetAttribute records an attribute such as "socks5.command".
+	SetAttribute(key string, value interface{})
+
+	// End completes the span.
+	End()
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) End()                                       {}
+
+func (s *Socks5) tracer() Tracer {
+	if s.config.Tracer != nil {
+		return s.config.Tracer
+	}
+	return noopTracer{}
+}
@@ -2,13 +2,35 @@ package socks5_test
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/Code-Hex/socks5"
+	"github.com/Code-Hex/socks5/address"
+	"github.com/Code-Hex/socks5/auth"
+	"github.com/Code-Hex/socks5/gssapi"
+	"github.com/Code-Hex/socks5/internal/addrutil"
+	"github.com/Code-Hex/socks5/internal/udputil"
 	"github.com/Code-Hex/socks5/proxy"
 	"github.com/Code-Hex/socks5/server"
 )
@@ -22,7 +44,7 @@ var addressCase = []string{
 func TestSocks5_UDPAssociate(t *testing.T) {
 	for _, address := range addressCase {
 		t.Run(address, func(t *testing.T) {
-			socks5Ln := socks5Server(t, address)
+			socks5Ln := socks5Server(t, address, nil)
 			socks5Addr := socks5Ln.Addr()
 
 			addr := echoUdpServer(t, address)
@@ -56,10 +78,555 @@ func TestSocks5_UDPAssociate(t *testing.T) {
 	}
 }
 
+func TestSocks5_UDPAssociateIsolation(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", nil)
+	socks5Addr := socks5Ln.Addr()
+
+	var conns []*proxy.Conn
+	for i := 0; i < 2; i++ {
+		addr := echoUdpServer(t, "127.0.0.1:0")
+		dialer, err := proxy.Socks5(context.Background(), socks5.CmdUDPAssociate, socks5Addr.Network(), socks5Addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dialer.Dial("udp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	relay1, relay2 := conns[0].UDPConn.RemoteAddr(), conns[1].UDPConn.RemoteAddr()
+	if relay1.String() == relay2.String() {
+		t.Fatalf("associations share the relay socket %s", relay1)
+	}
+
+	for i, conn := range conns {
+		if _, err := conn.Write([]byte{byte('A' + i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 10)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := string([]byte{byte('A' + i)}); string(buf[:n]) != want {
+			t.Fatalf("association %d: want %q, but got %q", i, want, buf[:n])
+		}
+	}
+}
+
+func TestSocks5_UDPAssociateSource(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", nil)
+	echoAddr := echoUdpServer(t, "127.0.0.1:0")
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	intruder, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer intruder.Close()
+
+	conn, relay := udpAssociate(t, socks5Ln.Addr(), client.LocalAddr())
+	defer conn.Close()
+
+	// datagrams from other than the client must be dropped.
+	frame := udpFrame(t, echoAddr, []byte("OK"))
+	if _, err := intruder.WriteTo(frame, relay); err != nil {
+		t.Fatal(err)
+	}
+	expectNoDatagram(t, intruder)
+
+	if _, err := client.WriteTo(frame, relay); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDatagram(t, client); got != "OK" {
+		t.Fatalf("want OK, but got %q", got)
+	}
+}
+
+func TestSocks5_UDPAssociateRuleSet(t *testing.T) {
+	allowed := echoUdpServer(t, "127.0.0.1:0")
+	denied := echoUdpServer(t, "127.0.0.1:0")
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		RuleSet: &server.RuleSet{
+			Rules: []server.Rule{{
+				Action: server.Allow,
+				Hosts:  []string{"127.0.0.1"},
+				Ports:  []server.PortRange{{From: allowed.(*net.UDPAddr).Port, To: allowed.(*net.UDPAddr).Port}},
+			}},
+			Default: server.Deny,
+		},
+	})
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// the client does not know its address, which the rules do not match.
+	conn, relay := udpAssociate(t, socks5Ln.Addr(), &net.UDPAddr{IP: net.IPv4zero})
+	defer conn.Close()
+
+	if _, err := client.WriteTo(udpFrame(t, denied, []byte("NG")), relay); err != nil {
+		t.Fatal(err)
+	}
+	expectNoDatagram(t, client)
+
+	if _, err := client.WriteTo(udpFrame(t, allowed, []byte("OK")), relay); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDatagram(t, client); got != "OK" {
+		t.Fatalf("want OK, but got %q", got)
+	}
+}
+
+func TestSocks5_UDPAssociateDeniedDestination(t *testing.T) {
+	denied := net.ParseIP("127.0.0.2")
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		GeoIPPolicy: func(ip net.IP) bool { return !ip.Equal(denied) },
+	})
+	echoAddr := echoUdpServer(t, "127.0.0.1:0")
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, relay := udpAssociate(t, socks5Ln.Addr(), client.LocalAddr())
+	defer conn.Close()
+
+	frame := udpFrame(t, &net.UDPAddr{IP: denied, Port: 9}, []byte("NG"))
+	if _, err := client.WriteTo(frame, relay); err != nil {
+		t.Fatal(err)
+	}
+	expectNoDatagram(t, client)
+
+	// the association survives the denied datagram.
+	if _, err := client.WriteTo(udpFrame(t, echoAddr, []byte("OK")), relay); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDatagram(t, client); got != "OK" {
+		t.Fatalf("want OK, but got %q", got)
+	}
+}
+
+func TestSocks5_UDPAssociateUndeliverable(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		ResolveFunc: func(ctx context.Context, host string) ([]net.IP, error) {
+			if host == "unknown.test" {
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+			return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+		},
+	})
+	echoAddr := echoUdpServer(t, "127.0.0.1:0")
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, relay := udpAssociate(t, socks5Ln.Addr(), client.LocalAddr())
+	defer conn.Close()
+
+	unresolvable := udputil.CreateFrame(address.TypeFQDN, 53, address.Host("unknown.test"), []byte("NG"))
+	if _, err := client.WriteTo(unresolvable, relay); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteTo(udpFrame(t, silent.LocalAddr(), []byte("NG")), relay); err != nil {
+		t.Fatal(err)
+	}
+
+	// neither the unresolvable nor the silent destination holds up the
+	// association.
+	start := time.Now()
+	if _, err := client.WriteTo(udpFrame(t, echoAddr, []byte("OK")), relay); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDatagram(t, client); got != "OK" {
+		t.Fatalf("want OK, but got %q", got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("want the reply without waiting for the silent destination, but took %v", elapsed)
+	}
+}
+
+func TestSocks5_UDPAssociateFragment(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", nil)
+	echoAddr := echoUdpServer(t, "127.0.0.1:0")
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, relay := udpAssociate(t, socks5Ln.Addr(), client.LocalAddr())
+	defer conn.Close()
+
+	// FRAG=1 must be dropped and must not end the association.
+	fragment := udpFrame(t, echoAddr, []byte("NG"))
+	fragment[2] = 1
+	if _, err := client.WriteTo(fragment, relay); err != nil {
+		t.Fatal(err)
+	}
+	expectNoDatagram(t, client)
+
+	if _, err := client.WriteTo(udpFrame(t, echoAddr, []byte("OK")), relay); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDatagram(t, client); got != "OK" {
+		t.Fatalf("want OK, but got %q", got)
+	}
+}
+
+func TestSocks5_UDPAssociateIPv6(t *testing.T) {
+	socks5Ln := socks5Server(t, "[::1]:0", nil)
+	echoAddr := echoUdpServer(t, "[::1]:0")
+
+	client, err := net.ListenPacket("udp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, bnd := sendRequest(t, conn, socks5.CmdUDPAssociate, client.LocalAddr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	if bnd.Type != address.TypeIPv6 {
+		t.Fatalf("want bound address type %s, but got %s", address.TypeIPv6, bnd.Type)
+	}
+	relay, err := net.ResolveUDPAddr("udp", bnd.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.WriteTo(udpFrame(t, echoAddr, []byte("OK")), relay); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 512)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, src, err := udputil.ExtractData(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "OK" {
+		t.Fatalf("want OK, but got %q", data)
+	}
+	if src.Type != address.TypeIPv6 || src.String() != echoAddr.String() {
+		t.Fatalf("want source %s, but got %s (%s)", echoAddr, src, src.Type)
+	}
+}
+
+func TestSocks5_UDPAssociateControlClosed(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", nil)
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, relay := udpAssociate(t, socks5Ln.Addr(), client.LocalAddr())
+	defer conn.Close()
+
+	echoAddr := echoUdpServer(t, "127.0.0.1:0")
+	if _, err := client.WriteTo(udpFrame(t, echoAddr, []byte("OK")), relay); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDatagram(t, client); got != "OK" {
+		t.Fatalf("want OK, but got %q", got)
+	}
+
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	echoAddr = echoUdpServer(t, "127.0.0.1:0")
+	if _, err := client.WriteTo(udpFrame(t, echoAddr, []byte("OK")), relay); err != nil {
+		t.Fatal(err)
+	}
+	expectNoDatagram(t, client)
+}
+
+func TestSocks5_UDPAssociateLargeDatagram(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", nil)
+	socks5Addr := socks5Ln.Addr()
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 64*1024)
+		n, addr, err := echo.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		echo.WriteTo(buf[:n], addr)
+	}()
+
+	dialer, err := proxy.Socks5(context.Background(), socks5.CmdUDPAssociate, socks5Addr.Network(), socks5Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a payload close to the maximum size of a datagram.
+	want := bytes.Repeat([]byte("0123456789"), 6000)
+	if _, err := conn.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	conn.UDPConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(want)+1)
+	n, err := conn.Read(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got[:n]) {
+		t.Fatalf("want %d bytes, but got %d bytes", len(want), n)
+	}
+}
+
+func TestSocks5_UDPBufferSize(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		UDPBufferSize: 512,
+	})
+	echoAddr := echoUdpServer(t, "127.0.0.1:0")
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, relay := udpAssociate(t, socks5Ln.Addr(), client.LocalAddr())
+	defer conn.Close()
+
+	// datagrams larger than the buffer must be dropped.
+	if _, err := client.WriteTo(udpFrame(t, echoAddr, make([]byte, 1000)), relay); err != nil {
+		t.Fatal(err)
+	}
+	expectNoDatagram(t, client)
+
+	if _, err := client.WriteTo(udpFrame(t, echoAddr, []byte("OK")), relay); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDatagram(t, client); got != "OK" {
+		t.Fatalf("want OK, but got %q", got)
+	}
+}
+
+func TestSocks5_UDPIdleTimeout(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		UDPIdleTimeout: 300 * time.Millisecond,
+	})
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	var clients []net.PacketConn
+	var conns []net.Conn
+	var relays []*net.UDPAddr
+	for i := 0; i < 2; i++ {
+		client, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		conn, relay := udpAssociate(t, socks5Ln.Addr(), client.LocalAddr())
+		defer conn.Close()
+		clients = append(clients, client)
+		conns = append(conns, conn)
+		relays = append(relays, relay)
+	}
+	// keep the second association active beyond the timeout.
+	frame := udpFrame(t, echo.LocalAddr(), []byte("OK"))
+	for i := 0; i < 6; i++ {
+		if _, err := clients[1].WriteTo(frame, relays[1]); err != nil {
+			t.Fatal(err)
+		}
+		if got := readDatagram(t, clients[1]); got != "OK" {
+			t.Fatalf("want OK, but got %q", got)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	conns[0].SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conns[0].Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("want idle association to be closed, but got %v", err)
+	}
+	conns[1].SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conns[1].Read(make([]byte, 1)); err == io.EOF {
+		t.Fatal("want active association to be alive")
+	}
+}
+
+func TestSocks5_UDPRewrite(t *testing.T) {
+	type call struct {
+		dir      server.Direction
+		src, dst string
+	}
+	calls := make(chan call, 10)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		UDPRewrite: func(dir server.Direction, src, dst net.Addr, payload []byte) []byte {
+			calls <- call{dir, src.String(), dst.String()}
+			if string(payload) == "drop" {
+				return nil
+			}
+			if dir == server.Outbound {
+				return bytes.ToUpper(payload)
+			}
+			return append(payload, '!')
+		},
+	})
+	echoAddr := echoUdpServer(t, "127.0.0.1:0")
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, relay := udpAssociate(t, socks5Ln.Addr(), client.LocalAddr())
+	defer conn.Close()
+
+	if _, err := client.WriteTo(udpFrame(t, echoAddr, []byte("drop")), relay); err != nil {
+		t.Fatal(err)
+	}
+	expectNoDatagram(t, client)
+
+	if _, err := client.WriteTo(udpFrame(t, echoAddr, []byte("ok")), relay); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDatagram(t, client); got != "OK!" {
+		t.Fatalf("want OK!, but got %q", got)
+	}
+
+	clientAddr, targetAddr := client.LocalAddr().String(), echoAddr.String()
+	want := []call{
+		{server.Outbound, clientAddr, targetAddr},
+		{server.Outbound, clientAddr, targetAddr},
+		{server.Inbound, targetAddr, clientAddr},
+	}
+	for i, w := range want {
+		if got := <-calls; got != w {
+			t.Fatalf("call %d: want %+v, but got %+v", i, w, got)
+		}
+	}
+}
+
+// udpAssociate requests UDP ASSOCIATE for datagrams from client and
+// returns the control connection and the relay address.
+func udpAssociate(t *testing.T, socks5Addr, client net.Addr) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+	conn, err := net.Dial("tcp", socks5Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, bnd := sendRequest(t, conn, socks5.CmdUDPAssociate, client.String())
+	if rep != socks5.StatusSucceeded {
+		conn.Close()
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	conn.SetDeadline(time.Time{})
+	relay, err := net.ResolveUDPAddr("udp", bnd.String())
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return conn, relay
+}
+
+// udpFrame creates the datagram to send data to dst via the relay.
+func udpFrame(t *testing.T, dst net.Addr, data []byte) []byte {
+	t.Helper()
+	host, port, err := addrutil.SplitHostPort(dst.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	aTyp, ip, err := addrutil.GetAddressInfo(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return udputil.CreateFrame(aTyp, port, ip, data)
+}
+
+// readDatagram reads a datagram from the relay and returns its data.
+func readDatagram(t *testing.T, conn net.PacketConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 512)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := udputil.ExtractData(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func expectNoDatagram(t *testing.T, conn net.PacketConn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, 512)
+	if _, _, err := conn.ReadFrom(buf); err == nil {
+		t.Fatal("expected datagram to be dropped")
+	}
+}
+
 func TestSocks5_Connect(t *testing.T) {
 	for _, address := range addressCase {
 		t.Run(address, func(t *testing.T) {
-			socks5Ln := socks5Server(t, address)
+			socks5Ln := socks5Server(t, address, nil)
 			echoLn := echoConnectServer(t, address)
 
 			socks5Addr := socks5Ln.Addr()
@@ -69,101 +636,3749 @@ func TestSocks5_Connect(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			echoAddr := echoLn.Addr()
-			conn, err := p.Dial(echoAddr.Network(), echoAddr.String())
-			if err != nil {
-				t.Fatal(err)
+			echoAddr := echoLn.Addr()
+			conn, err := p.Dial(echoAddr.Network(), echoAddr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			want := "OK"
+			if _, err := conn.Write([]byte(want)); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := make([]byte, 2)
+			if _, err := conn.Read(buf); err != nil {
+				t.Fatal(err)
+			}
+
+			got := string(buf)
+			if want != got {
+				t.Fatalf(`want %s, but got %s`, want, got)
+			}
+		})
+	}
+}
+
+func TestSocks5_ConnectBoundAddr(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", nil)
+
+	echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoLn.Close()
+	peerAddr := make(chan net.Addr, 1)
+	go func() {
+		conn, err := echoLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		peerAddr <- conn.RemoteAddr()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	negotiate(t, conn, auth.MethodNotRequired)
+	msg := []byte{socks5.Version, byte(socks5.CmdConnect), 0, byte(address.TypeIPv4), 127, 0, 0, 1}
+	port := echoLn.Addr().(*net.TCPAddr).Port
+	msg = append(msg, byte(port>>8), byte(port))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var outbound net.Addr
+	select {
+	case outbound = <-peerAddr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("target has not been connected")
+	}
+	bndPort := outbound.(*net.TCPAddr).Port
+	want := []byte{socks5.Version, byte(socks5.StatusSucceeded), 0, byte(address.TypeIPv4), 127, 0, 0, 1, byte(bndPort >> 8), byte(bndPort)}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatalf("want reply %v, but got %v", want, got)
+	}
+}
+
+func TestSocks5_ConnectHalfClose(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", nil)
+
+	// the target replies after it has read everything from the client.
+	targetLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer targetLn.Close()
+	go func() {
+		conn, err := targetLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		conn.Write(append([]byte("got "), b...))
+	}()
+
+	socks5Addr := socks5Ln.Addr()
+	p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := p.Dial("tcp", targetLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "got request"; string(got) != want {
+		t.Fatalf("want %q, but got %q", want, got)
+	}
+}
+
+func TestSocks5_LocalIP(t *testing.T) {
+	cases := []struct {
+		name string
+		c    *server.Config
+		want string
+	}{
+		{"config", &server.Config{LocalIP: net.ParseIP("127.0.0.2")}, "127.0.0.2"},
+		{"hook", &server.Config{
+			LocalIP: net.ParseIP("127.0.0.2"),
+			SelectLocalIP: func(ctx context.Context, network, address string) net.IP {
+				return net.ParseIP("127.0.0.3")
+			},
+		}, "127.0.0.3"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			socks5Ln := socks5Server(t, "127.0.0.1:0", tc.c)
+
+			targetLn, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer targetLn.Close()
+			source := make(chan net.Addr, 1)
+			go func() {
+				conn, err := targetLn.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				source <- conn.RemoteAddr()
+			}()
+
+			socks5Addr := socks5Ln.Addr()
+			p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := p.Dial("tcp", targetLn.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			select {
+			case addr := <-source:
+				if got := addr.(*net.TCPAddr).IP.String(); got != tc.want {
+					t.Fatalf("want source IP %s, but got %s", tc.want, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("target has not been connected")
+			}
+		})
+	}
+}
+
+func TestSocks5_ConnectIPv6(t *testing.T) {
+	echoLn := echoConnectServer(t, "[::1]:0")
+	dialed := make(chan string, 1)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed <- address
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	})
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	negotiate(t, conn, auth.MethodNotRequired)
+
+	// send the IPv6 address in two writes to check it is read fully.
+	port := echoLn.Addr().(*net.TCPAddr).Port
+	msg := []byte{socks5.Version, byte(socks5.CmdConnect), 0, byte(address.TypeIPv6)}
+	msg = append(msg, net.IPv6loopback...)
+	msg = append(msg, byte(port>>8), byte(port))
+	if _, err := conn.Write(msg[:10]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := conn.Write(msg[10:]); err != nil {
+		t.Fatal(err)
+	}
+	rep, bnd := readReply(t, conn)
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	if bnd.Type != address.TypeIPv6 {
+		t.Fatalf("want bound address type %s, but got %s", address.TypeIPv6, bnd.Type)
+	}
+	if want, got := echoLn.Addr().String(), <-dialed; want != got {
+		t.Fatalf("want dialed address %s, but got %s", want, got)
+	}
+
+	want := "OK"
+	if _, err := conn.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); want != got {
+		t.Fatalf("want %s, but got %s", want, got)
+	}
+}
+
+func TestSocks5_ConnectIDN(t *testing.T) {
+	dialed := make(chan string, 1)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed <- address
+			return nil, errors.New("not dialed")
+		},
+	})
+
+	cases := []struct {
+		host string
+		want socks5.Reply
+	}{
+		{"例え.テスト", socks5.StatusGeneralServerFailure},
+		{"\xff.example.com", socks5.StatusAddrTypeNotSupported},
+		{"ü_x.example.com", socks5.StatusAddrTypeNotSupported},
+		{"exa\x00mple.com", socks5.StatusAddrTypeNotSupported},
+	}
+	for _, tc := range cases {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, net.JoinHostPort(tc.host, "80"))
+		conn.Close()
+		if rep != tc.want {
+			t.Fatalf("%q: want %q, but got %q", tc.host, tc.want, rep)
+		}
+	}
+
+	// only the valid name has been dialed.
+	if want, got := "xn--r8jz45g.xn--zckzah:80", <-dialed; want != got {
+		t.Fatalf("want dialed address %s, but got %s", want, got)
+	}
+}
+
+func TestSocks5_EmptyFQDN(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			t.Errorf("unexpected dial to %q", address)
+			return nil, errors.New("not dialed")
+		},
+	})
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	negotiate(t, conn, auth.MethodNotRequired)
+	msg := []byte{socks5.Version, byte(socks5.CmdConnect), 0, byte(address.TypeFQDN), 0, 0, 80}
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if rep, _ := readReply(t, conn); rep != socks5.StatusAddrTypeNotSupported {
+		t.Fatalf("want %q, but got %q", socks5.StatusAddrTypeNotSupported, rep)
+	}
+}
+
+func TestSocks5_TruncatedFQDN(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		HandshakeTimeout: 200 * time.Millisecond,
+	})
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	negotiate(t, conn, auth.MethodNotRequired)
+
+	// the length says 11 bytes, but only 7 bytes are delivered.
+	msg := []byte{socks5.Version, byte(socks5.CmdConnect), 0, byte(address.TypeFQDN), 11}
+	msg = append(msg, "example"...)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("want connection to be closed, but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("server blocked for %v", elapsed)
+	}
+}
+
+func TestSocks5_RequestReadTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		RequestReadTimeout: timeout,
+	})
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the timeout does not apply to method negotiation.
+	time.Sleep(2 * timeout)
+	negotiate(t, conn, auth.MethodNotRequired)
+
+	// stall after sending a part of the request.
+	if _, err := conn.Write([]byte{socks5.Version, byte(socks5.CmdConnect), 0}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("want connection to be closed, but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout/2 || elapsed > 2*time.Second {
+		t.Fatalf("want connection to be closed after %v, but got %v", timeout, elapsed)
+	}
+}
+
+func TestSocks5_MaxRequestDuration(t *testing.T) {
+	const budget = 200 * time.Millisecond
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		MaxRequestDuration: budget,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// the destination answers slowly.
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(5 * time.Second):
+				return nil, errors.New("budget is not applied")
+			}
+		},
+	})
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, "192.0.2.1:80")
+	if rep != socks5.StatusTTLExpired {
+		t.Fatalf("want %q, but got %q", socks5.StatusTTLExpired, rep)
+	}
+	if elapsed := time.Since(start); elapsed < budget/2 || elapsed > 2*time.Second {
+		t.Fatalf("want the request to be aborted after %v, but got %v", budget, elapsed)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("want connection to be closed, but got %v", err)
+	}
+}
+
+func TestSocks5_MaxRequestDurationUDP(t *testing.T) {
+	const budget = 200 * time.Millisecond
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		MaxRequestDuration: budget,
+	})
+	echoAddr := echoUdpServer(t, "127.0.0.1:0")
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, relay := udpAssociate(t, socks5Ln.Addr(), client.LocalAddr())
+	defer conn.Close()
+
+	// the budget does not apply to the association once it has started.
+	time.Sleep(2 * budget)
+	if _, err := client.WriteTo(udpFrame(t, echoAddr, []byte("OK")), relay); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDatagram(t, client); got != "OK" {
+		t.Fatalf("want OK, but got %q", got)
+	}
+}
+
+func TestSocks5_AdvertisedAddr(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AdvertisedAddr: "192.0.2.1",
+	})
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, bnd := sendRequest(t, conn, socks5.CmdUDPAssociate, client.LocalAddr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	if bnd.Type != address.TypeIPv4 || !bytes.Equal(bnd.Host, []byte{192, 0, 2, 1}) {
+		t.Fatalf("want advertised address 192.0.2.1, but got %s", bnd)
+	}
+	if bnd.Port == 0 {
+		t.Fatal("want bound port, but got 0")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestSocks5_ConnectErrorReply(t *testing.T) {
+	dialError := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	cases := []struct {
+		name string
+		err  error
+		want socks5.Reply
+	}{
+		{"refused", dialError(os.NewSyscallError("connect", syscall.ECONNREFUSED)), socks5.StatusConnectionRefused},
+		{"network unreachable", dialError(os.NewSyscallError("connect", syscall.ENETUNREACH)), socks5.StatusNetworkUnreachable},
+		{"host unreachable", dialError(os.NewSyscallError("connect", syscall.EHOSTUNREACH)), socks5.StatusHostUnreachable},
+		{"timeout", dialError(timeoutError{}), socks5.StatusTTLExpired},
+		{"deadline", context.DeadlineExceeded, socks5.StatusTTLExpired},
+		{"other", errors.New("failure"), socks5.StatusGeneralServerFailure},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					return nil, tc.err
+				},
+			})
+
+			conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			negotiate(t, conn, auth.MethodNotRequired)
+			if rep, _ := sendRequest(t, conn, socks5.CmdConnect, "127.0.0.1:80"); rep != tc.want {
+				t.Fatalf("want %q, but got %q", tc.want, rep)
+			}
+		})
+	}
+}
+
+func TestSocks5_Bind(t *testing.T) {
+	for _, address := range addressCase {
+		t.Run(address, func(t *testing.T) {
+			socks5Ln := socks5Server(t, address, nil)
+			ctx := context.Background()
+			socks5Addr := socks5Ln.Addr()
+
+			dialer, err := proxy.Socks5(ctx, socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			echoLn, waitCh := echoBindServer(t, address)
+			echoAddr := echoLn.Addr()
+			conn1, err := dialer.Dial(echoAddr.Network(), echoAddr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn1.Close()
+
+			dialer2, err := proxy.Socks5(ctx, socks5.CmdBind, socks5Addr.Network(), socks5Addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ln, err := dialer2.Listen("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := ln.Addr()
+			_, err = conn1.Write([]byte(addr.String() + "\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// wait to dial tcp from echo bind server
+			<-waitCh
+
+			want := "OK"
+			_, err = conn1.Write([]byte(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn2, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn2.Close()
+
+			buf := make([]byte, 2)
+			if _, err := conn2.Read(buf); err != nil {
+				t.Fatal(err)
+			}
+			got := string(buf)
+			if want != got {
+				t.Fatalf("want %s, but got %s", want, got)
+			}
+		})
+	}
+}
+
+type authRecord struct {
+	method auth.Method
+	user   string
+	err    error
+}
+
+func TestSocks5_AuthFailureLimiter(t *testing.T) {
+	limiter := &server.AuthFailureLimiter{
+		MaxFailures: 2,
+		Window:      time.Minute,
+		BanDuration: time.Minute,
+	}
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &server.UsernamePassword{
+				Check: server.NewStaticCredentials(map[string]string{"user": "pass"}).Check,
+			},
+		},
+		AuthFailureLimiter: limiter,
+	})
+	socks5Addr := socks5Ln.Addr()
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	dial := func(password string) error {
+		p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.AuthMethods = map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &proxy.UsernamePassword{Username: "user", Password: password},
+		}
+		conn, err := p.Dial("tcp", echoLn.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// the valid account does not clear the failure in between.
+	if err := dial("wrong"); err == nil {
+		t.Fatal("want authentication to fail")
+	}
+	if err := dial("pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dial("wrong"); err == nil {
+		t.Fatal("want authentication to fail")
+	}
+	ip := net.ParseIP("127.0.0.1")
+	for deadline := time.Now().Add(5 * time.Second); !limiter.Banned(ip); {
+		if time.Now().After(deadline) {
+			t.Fatal("want the client to be banned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := dial("pass"); err == nil {
+		t.Fatal("want the banned client to be refused")
+	}
+}
+
+func TestSocks5_UsernamePassword(t *testing.T) {
+	records := make(chan authRecord, 1)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &server.UsernamePassword{
+				Check: func(username, password string) bool {
+					return username == "user" && password == "pass"
+				},
+			},
+		},
+		OnAuth: func(_ net.Addr, method auth.Method, user string, err error) {
+			records <- authRecord{method: method, user: user, err: err}
+		},
+	})
+	socks5Addr := socks5Ln.Addr()
+
+	cases := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{name: "valid", password: "pass"},
+		{name: "invalid", password: "wrong", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			echoLn := echoConnectServer(t, "127.0.0.1:0")
+			ctx := context.Background()
+			p, err := proxy.Socks5(ctx, socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.AuthMethods = map[auth.Method]auth.Authenticator{
+				auth.MethodUsernamePassword: &proxy.UsernamePassword{
+					Username: "user",
+					Password: tc.password,
+				},
+			}
+
+			echoAddr := echoLn.Addr()
+			conn, err := p.Dial(echoAddr.Network(), echoAddr.String())
+
+			record := <-records
+			if record.method != auth.MethodUsernamePassword || record.user != "user" {
+				t.Fatalf("unexpected OnAuth record: %+v", record)
+			}
+			if tc.wantErr != (record.err != nil) {
+				t.Fatalf("unexpected OnAuth error: %v", record.err)
+			}
+
+			if tc.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("expected authentication error")
+				}
+				if !errors.Is(err, auth.ErrAuthenticationFailed) {
+					t.Fatalf("want %v, but got %v", auth.ErrAuthenticationFailed, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			want := "OK"
+			if _, err := conn.Write([]byte(want)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 2)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf); want != got {
+				t.Fatalf(`want %s, but got %s`, want, got)
+			}
+		})
+	}
+}
+
+func TestSocks5_UserFromContext(t *testing.T) {
+	userCh := make(chan string, 1)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &server.UsernamePassword{
+				Check: server.NewStaticCredentials(map[string]string{"user": "pass"}).Check,
+			},
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			user, _ := server.UserFromContext(ctx)
+			userCh <- user
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, "tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AuthMethods = map[auth.Method]auth.Authenticator{
+		auth.MethodUsernamePassword: &proxy.UsernamePassword{Username: "user", Password: "pass"},
+	}
+	conn, err := p.Dial("tcp", echoLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if got := <-userCh; got != "user" {
+		t.Fatalf("want %q, but got %q", "user", got)
+	}
+}
+
+func TestSocks5_NoAcceptableMethods(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", nil)
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte{socks5.Version, 1, byte(auth.MethodUsernamePassword)}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{socks5.Version, byte(auth.MethodNoAcceptableMethods)}
+	if !bytes.Equal(want, buf) {
+		t.Fatalf("want %v, but got %v", want, buf)
+	}
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("want %v, but got %v", io.EOF, err)
+	}
+}
+
+func TestSocks5_UserQuota(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &server.UsernamePassword{
+				Check: server.NewStaticCredentials(map[string]string{"user": "pass"}).Check,
+			},
+		},
+		UserQuota: &server.MemoryQuota{MaxConns: 1},
+	})
+
+	p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, "tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AuthMethods = map[auth.Method]auth.Authenticator{
+		auth.MethodUsernamePassword: &proxy.UsernamePassword{Username: "user", Password: "pass"},
+	}
+
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+	conn, err := p.Dial("tcp", echoLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	echoLn2 := echoConnectServer(t, "127.0.0.1:0")
+	_, err = p.Dial("tcp", echoLn2.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), socks5.StatusNotAllowedByRuleSet.String()) {
+		t.Fatalf("want %q, but got %v", socks5.StatusNotAllowedByRuleSet, err)
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	reads int32
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	atomic.AddInt32(&c.reads, 1)
+	return c.Conn.Read(b)
+}
+
+func TestSocks5_AuthenticatorConn(t *testing.T) {
+	wrapped := make(chan *countingConn, 1)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodNotRequired: auth.FuncAuthenticator(func(ctx context.Context, conn net.Conn) (*auth.Result, error) {
+				c := &countingConn{Conn: conn}
+				wrapped <- c
+				return &auth.Result{Conn: c}, nil
+			}),
+		},
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, "tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := p.Dial("tcp", echoLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := "OK"
+	if _, err := conn.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); want != got {
+		t.Fatalf(`want %s, but got %s`, want, got)
+	}
+
+	// the request and the relayed data must be read through the wrapper.
+	if reads := atomic.LoadInt32(&(<-wrapped).reads); reads < 2 {
+		t.Fatalf("wrapped conn was not used: %d reads", reads)
+	}
+}
+
+func TestSocks5_NoMethods(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", nil)
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte{socks5.Version, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 2)); err != io.EOF {
+		t.Fatalf("want %v, but got %v", io.EOF, err)
+	}
+}
+
+func TestSocks5_FuncAuthenticator(t *testing.T) {
+	const method auth.Method = 0x80 // private method
+
+	entered := make(chan struct{})
+	errCh := make(chan error, 1)
+	s := server.New(&server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			method: auth.FuncAuthenticator(func(ctx context.Context, conn net.Conn) (*auth.Result, error) {
+				close(entered)
+				<-ctx.Done()
+				errCh <- ctx.Err()
+				return nil, ctx.Err()
+			}),
+		},
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{socks5.Version, 1, byte(method)}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[1] != byte(method) {
+		t.Fatalf("want method %d, but got %d", method, buf[1])
+	}
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("want %v, but got %v", context.Canceled, err)
+	}
+
+	// connection must be closed after failed authentication.
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("want %v, but got %v", io.EOF, err)
+	}
+}
+
+func TestSocks5_ShutdownClosesListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(nil)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Serve(ln)
+	}()
+	// let Serve block in Accept.
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errCh:
+		if err != server.ErrServerClosed {
+			t.Fatalf("want %v, but got %v", server.ErrServerClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve is still blocked in Accept")
+	}
+	if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("want the listener to be closed")
+	}
+}
+
+func TestSocks5_Close(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(nil)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Serve(ln)
+	}()
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the relay is terminated without waiting for EOF from the client.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("want connection to be closed, but got %v", err)
+	}
+	select {
+	case err := <-errCh:
+		if err != server.ErrServerClosed {
+			t.Fatalf("want %v, but got %v", server.ErrServerClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve does not return")
+	}
+}
+
+func TestSocks5_RegisterOnShutdown(t *testing.T) {
+	s := server.New(nil)
+	var calls int32
+	done := make(chan struct{})
+	s.RegisterOnShutdown(func() {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(done)
+		}
+	})
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Fatal("called before Shutdown")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if err := s.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not called after Shutdown")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("want 1 call, but got %d", got)
+	}
+}
+
+func TestSocks5_ShutdownWaitsForAcceptedConn(t *testing.T) {
+	release := make(chan struct{})
+	shutdownErr := make(chan error, 1)
+	var s *server.Socks5
+	s = server.New(&server.Config{
+		// start shutting down before the connection reaches serveConn.
+		OnConnect: func(ctx context.Context, conn net.Conn) {
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				shutdownErr <- s.Shutdown(ctx)
+			}()
+			time.Sleep(50 * time.Millisecond)
+		},
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodNotRequired: auth.FuncAuthenticator(func(ctx context.Context, conn net.Conn) (*auth.Result, error) {
+				<-release
+				return nil, ctx.Err()
+			}),
+		},
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{socks5.Version, 1, byte(auth.MethodNotRequired)}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned with the connection being served: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdownErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSocks5_ShutdownInterruptsRelay(t *testing.T) {
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+	cases := []struct {
+		cmd  socks5.Command
+		addr string
+	}{
+		{socks5.CmdConnect, echoLn.Addr().String()},
+		// the peer never connects.
+		{socks5.CmdBind, "127.0.0.1:0"},
+		// the association is idle.
+		{socks5.CmdUDPAssociate, "127.0.0.1:0"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.cmd.String(), func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := server.New(nil)
+			go s.Serve(ln)
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			negotiate(t, conn, auth.MethodNotRequired)
+			rep, _ := sendRequest(t, conn, tc.cmd, tc.addr)
+			if rep != socks5.StatusSucceeded {
+				t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			start := time.Now()
+			if err := s.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("Shutdown waited for the relay for %v", elapsed)
+			}
+			// BIND may send the failure reply before closing.
+			if _, err := ioutil.ReadAll(conn); err != nil {
+				t.Fatalf("want connection to be closed, but got %v", err)
+			}
+		})
+	}
+}
+
+func TestSocks5_ShutdownForceClose(t *testing.T) {
+	s := server.New(&server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			// the authenticator is stuck without watching ctx.
+			auth.MethodNotRequired: auth.FuncAuthenticator(func(ctx context.Context, conn net.Conn) (*auth.Result, error) {
+				_, err := conn.Read(make([]byte, 1))
+				return nil, err
+			}),
+		},
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+
+	const timeout = 100 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("want %v, but got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 2*time.Second {
+		t.Fatalf("want Shutdown to return after %v, but got %v", timeout, elapsed)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("want connection to be closed, but got %v", err)
+	}
+}
+
+func TestSocks5_ShutdownForceCloseUntracked(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	s := server.New(&server.Config{
+		// the connection reaches serveConn after the deadline of Shutdown.
+		OnConnect: func(ctx context.Context, conn net.Conn) {
+			time.Sleep(3 * timeout)
+		},
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// wait for the connection to be accepted.
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("want %v, but got %v", context.DeadlineExceeded, err)
+	}
+	// no request is sent, so the connection is left in the handshake.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("want connection to be closed, but got %v", err)
+	}
+}
+
+type fakeGSSProvider struct{}
+
+func (fakeGSSProvider) NewContext() (gssapi.Context, error) { return &fakeGSSContext{}, nil }
+
+type fakeGSSContext struct{}
+
+func (c *fakeGSSContext) Accept(token []byte) ([]byte, bool, error) {
+	if string(token) != "client-token" {
+		return nil, false, errors.New("invalid token")
+	}
+	return []byte("server-token"), true, nil
+}
+
+func (c *fakeGSSContext) SourceName() string                      { return "client@EXAMPLE.COM" }
+func (c *fakeGSSContext) Wrap(msg []byte, _ bool) ([]byte, error) { return msg, nil }
+func (c *fakeGSSContext) Unwrap(msg []byte) ([]byte, error)       { return msg, nil }
+
+func TestSocks5_GSSAPI(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodGSSAPI: &server.GSSAPI{Provider: fakeGSSProvider{}},
+		},
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	ctx := context.Background()
+	p, err := proxy.Socks5(ctx, socks5.CmdConnect, "tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AuthMethods = map[auth.Method]auth.Authenticator{
+		auth.MethodGSSAPI: auth.FuncAuthenticator(func(ctx context.Context, conn net.Conn) (*auth.Result, error) {
+			if err := gssapi.WriteMessage(conn, gssapi.MessageAuthentication, []byte("client-token")); err != nil {
+				return nil, err
+			}
+			mtyp, token, err := gssapi.ReadMessage(conn)
+			if err != nil {
+				return nil, err
+			}
+			if mtyp != gssapi.MessageAuthentication || string(token) != "server-token" {
+				return nil, fmt.Errorf("unexpected message: %d %q", mtyp, token)
+			}
+			level := []byte{byte(gssapi.ProtectionIntegrity)}
+			if err := gssapi.WriteMessage(conn, gssapi.MessageProtection, level); err != nil {
+				return nil, err
+			}
+			mtyp, token, err = gssapi.ReadMessage(conn)
+			if err != nil {
+				return nil, err
+			}
+			if mtyp != gssapi.MessageProtection || len(token) != 1 || token[0] != byte(gssapi.ProtectionNone) {
+				return nil, fmt.Errorf("unexpected protection level: %d %v", mtyp, token)
+			}
+			return nil, nil
+		}),
+	}
+
+	conn, err := p.Dial("tcp", echoLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := "OK"
+	if _, err := conn.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); want != got {
+		t.Fatalf(`want %s, but got %s`, want, got)
+	}
+}
+
+func TestSocks5_HandshakeTimeout(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		HandshakeTimeout: 100 * time.Millisecond,
+	})
+
+	t.Run("stalled", func(t *testing.T) {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		// stall without sending method negotiation.
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("want %v, but got %v", io.EOF, err)
+		}
+	})
+
+	t.Run("relay outlives timeout", func(t *testing.T) {
+		echoLn := echoConnectServer(t, "127.0.0.1:0")
+		p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, "tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := p.Dial("tcp", echoLn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		time.Sleep(200 * time.Millisecond)
+
+		want := "OK"
+		if _, err := conn.Write([]byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf); want != got {
+			t.Fatalf(`want %s, but got %s`, want, got)
+		}
+	})
+}
+
+func TestSocks5_ClientCertMapper(t *testing.T) {
+	// Debug wraps the connection, which must not hide TLS.
+	for _, debug := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Debug=%t", debug), func(t *testing.T) {
+			testClientCertMapper(t, debug)
+		})
+	}
+}
+
+func testClientCertMapper(t *testing.T, debug bool) {
+	serverCert := generateCert(t, "server")
+	clientCert := generateCert(t, "client")
+
+	userCh := make(chan string, 1)
+	s := server.New(&server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &server.UsernamePassword{},
+		},
+		RequireAuth: true,
+		Debug:       debug,
+		ErrorLog:    log.New(ioutil.Discard, "", 0),
+		ClientCertMapper: func(cert *x509.Certificate) (string, bool) {
+			return cert.Subject.CommonName, cert.Subject.CommonName == "client"
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			user, _ := server.UserFromContext(ctx)
+			userCh <- user
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	})
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.Serve(ln)
+
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		Certificates:       []tls.Certificate{clientCert},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if method := negotiate(t, conn, auth.MethodNotRequired); method != auth.MethodNotRequired {
+		t.Fatalf("want method %d, but got %d", auth.MethodNotRequired, method)
+	}
+	if rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String()); rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	if got := <-userCh; got != "client" {
+		t.Fatalf("want %q, but got %q", "client", got)
+	}
+}
+
+func generateCert(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+// negotiate sends method negotiation and returns the method selected by
+// the server.
+func negotiate(t *testing.T, conn net.Conn, methods ...auth.Method) auth.Method {
+	t.Helper()
+	msg := []byte{socks5.Version, byte(len(methods))}
+	for _, method := range methods {
+		msg = append(msg, byte(method))
+	}
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != socks5.Version {
+		t.Fatalf("unexpected version: %d", buf[0])
+	}
+	return auth.Method(buf[1])
+}
+
+// sendRequest sends the request for addr and returns the reply.
+func sendRequest(t *testing.T, conn net.Conn, cmd socks5.Command, addr string) (socks5.Reply, *address.Info) {
+	t.Helper()
+	host, port, err := addrutil.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aTyp, hostBytes, err := addrutil.GetAddressInfo(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte{socks5.Version, byte(cmd), 0, byte(aTyp)}
+	if aTyp == address.TypeFQDN {
+		msg = append(msg, byte(len(hostBytes)))
+	}
+	msg = append(msg, hostBytes...)
+	msg = append(msg, byte(port>>8), byte(port))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	return readReply(t, conn)
+}
+
+func readReply(t *testing.T, conn net.Conn) (socks5.Reply, *address.Info) {
+	t.Helper()
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != socks5.Version {
+		t.Fatalf("unexpected version: %d", buf[0])
+	}
+	bnd, err := addrutil.Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return socks5.Reply(buf[1]), bnd
+}
+
+func TestSocks5_BindSingleConnection(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", nil)
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, bnd := sendRequest(t, conn, socks5.CmdBind, "127.0.0.1:0")
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+
+	peer, err := net.Dial("tcp", bnd.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	rep, peerAddr := readReply(t, conn)
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	if want := peer.LocalAddr().String(); peerAddr.String() != want {
+		t.Fatalf("want peer address %s, but got %s", want, peerAddr)
+	}
+
+	// additional connections must be refused.
+	if c, err := net.Dial("tcp", bnd.String()); err == nil {
+		c.Close()
+		t.Fatal("expected second connection to be refused")
+	}
+
+	want := "OK"
+	if _, err := peer.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); want != got {
+		t.Fatalf("want %s, but got %s", want, got)
+	}
+}
+
+func TestSocks5_AllowedCommands(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AllowedCommands: []socks5.Command{socks5.CmdConnect},
+	})
+
+	for _, cmd := range []socks5.Command{socks5.CmdBind, socks5.CmdUDPAssociate} {
+		t.Run(cmd.String(), func(t *testing.T) {
+			conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			negotiate(t, conn, auth.MethodNotRequired)
+			rep, _ := sendRequest(t, conn, cmd, "127.0.0.1:0")
+			if rep != socks5.StatusCommandNotSupported {
+				t.Fatalf("want %q, but got %q", socks5.StatusCommandNotSupported, rep)
+			}
+		})
+	}
+}
+
+func TestSocks5_ClientNetworks(t *testing.T) {
+	cidrs := func(s ...string) []*net.IPNet {
+		var nets []*net.IPNet
+		for _, cidr := range s {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nets = append(nets, n)
+		}
+		return nets
+	}
+	cases := []struct {
+		name    string
+		address string
+		c       *server.Config
+		allowed bool
+	}{
+		{"empty", "127.0.0.1:0", &server.Config{}, true},
+		{"allowed", "127.0.0.1:0", &server.Config{AllowedClients: cidrs("127.0.0.0/8")}, true},
+		{"not in allowed", "127.0.0.1:0", &server.Config{AllowedClients: cidrs("10.0.0.0/8", "::1/128")}, false},
+		{"denied", "127.0.0.1:0", &server.Config{DeniedClients: cidrs("127.0.0.1/32")}, false},
+		{"denied over allowed", "127.0.0.1:0", &server.Config{
+			AllowedClients: cidrs("127.0.0.0/8"),
+			DeniedClients:  cidrs("127.0.0.1/32"),
+		}, false},
+		{"ipv6 allowed", "[::1]:0", &server.Config{AllowedClients: cidrs("::1/128")}, true},
+		{"ipv6 denied", "[::1]:0", &server.Config{DeniedClients: cidrs("::/0")}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			socks5Ln := socks5Server(t, tc.address, tc.c)
+			conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// the write may fail if the connection has been already closed.
+			conn.Write([]byte{socks5.Version, 1, byte(auth.MethodNotRequired)})
+			_, err = io.ReadFull(conn, make([]byte, 2))
+			if tc.allowed && err != nil {
+				t.Fatalf("want method selection, but got %v", err)
+			}
+			if !tc.allowed && err == nil {
+				t.Fatal("want connection to be closed")
+			}
+		})
+	}
+}
+
+func TestSocks5_RuleSet(t *testing.T) {
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+	echoPort := echoLn.Addr().(*net.TCPAddr).Port
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		RuleSet: &server.RuleSet{
+			Rules: []server.Rule{
+				{Action: server.Allow, Hosts: []string{"127.0.0.0/8"}, Ports: []server.PortRange{{From: echoPort, To: echoPort}}},
+			},
+		},
+	})
+
+	socks5Addr := socks5Ln.Addr()
+	p, err := proxy.Socks5(context.Background(), socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := p.Dial("tcp", echoLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	raw, err := net.Dial("tcp", socks5Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, raw, auth.MethodNotRequired)
+	if rep, _ := sendRequest(t, raw, socks5.CmdConnect, "127.0.0.1:1"); rep != socks5.StatusNotAllowedByRuleSet {
+		t.Fatalf("want %q, but got %q", socks5.StatusNotAllowedByRuleSet, rep)
+	}
+}
+
+func TestSocks5_BlockedDomains(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		BlockedDomains: []string{"*.ads.example.com"},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("not dialed")
+		},
+	})
+
+	cases := []struct {
+		addr string
+		want socks5.Reply
+	}{
+		{"banner.ADS.example.com:443", socks5.StatusNotAllowedByRuleSet},
+		{"www.example.com:443", socks5.StatusGeneralServerFailure},
+	}
+	for _, tc := range cases {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, tc.addr)
+		conn.Close()
+		if rep != tc.want {
+			t.Fatalf("%s: want %q, but got %q", tc.addr, tc.want, rep)
+		}
+	}
+}
+
+func TestSocks5_AllowedPorts(t *testing.T) {
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+	echoPort := echoLn.Addr().(*net.TCPAddr).Port
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AllowedPorts: []server.PortRange{{From: echoPort, To: echoPort}},
+	})
+
+	cases := []struct {
+		port int
+		want socks5.Reply
+	}{
+		{echoPort, socks5.StatusSucceeded},
+		{echoPort + 1, socks5.StatusNotAllowedByRuleSet},
+	}
+	for _, tc := range cases {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, fmt.Sprintf("127.0.0.1:%d", tc.port))
+		conn.Close()
+		if rep != tc.want {
+			t.Fatalf("port %d: want %q, but got %q", tc.port, tc.want, rep)
+		}
+	}
+}
+
+func TestSocks5_UserRules(t *testing.T) {
+	onlyPort := func(port int) *server.RuleSet {
+		return &server.RuleSet{
+			Rules: []server.Rule{{Action: server.Allow, Ports: []server.PortRange{{From: port, To: port}}}},
+		}
+	}
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &server.UsernamePassword{
+				Check: server.NewStaticCredentials(map[string]string{
+					"alice": "pass", "bob": "pass", "carol": "pass",
+				}).Check,
+			},
+		},
+		RuleSet: onlyPort(3),
+		UserRules: map[string]*server.RuleSet{
+			"alice": onlyPort(1),
+			"bob":   onlyPort(2),
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("not dialed")
+		},
+	})
+
+	cases := []struct {
+		user string
+		port int
+		want socks5.Reply
+	}{
+		{"alice", 1, socks5.StatusGeneralServerFailure},
+		{"alice", 2, socks5.StatusNotAllowedByRuleSet},
+		{"bob", 1, socks5.StatusNotAllowedByRuleSet},
+		{"bob", 2, socks5.StatusGeneralServerFailure},
+		{"carol", 1, socks5.StatusNotAllowedByRuleSet},
+		{"carol", 3, socks5.StatusGeneralServerFailure},
+	}
+	for _, tc := range cases {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodUsernamePassword)
+		up := &proxy.UsernamePassword{Username: tc.user, Password: "pass"}
+		if _, err := up.Authenticate(context.Background(), conn); err != nil {
+			t.Fatal(err)
+		}
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, fmt.Sprintf("127.0.0.1:%d", tc.port))
+		conn.Close()
+		if rep != tc.want {
+			t.Fatalf("%s to port %d: want %q, but got %q", tc.user, tc.port, tc.want, rep)
+		}
+	}
+}
+
+func TestSocks5_Authorize(t *testing.T) {
+	type call struct {
+		cmd socks5.Command
+		dst string
+	}
+	calls := make(chan call, 3)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		Authorize: func(ctx context.Context, user string, cmd socks5.Command, dst *address.Info) error {
+			calls <- call{cmd, dst.String()}
+			if dst.Port == 25 {
+				return errors.New("smtp is not allowed")
+			}
+			return nil
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("not dialed")
+		},
+	})
+
+	cases := []struct {
+		cmd  socks5.Command
+		addr string
+		want socks5.Reply
+	}{
+		{socks5.CmdConnect, "127.0.0.1:25", socks5.StatusNotAllowedByRuleSet},
+		{socks5.CmdConnect, "127.0.0.1:80", socks5.StatusGeneralServerFailure},
+		{socks5.CmdBind, "127.0.0.1:25", socks5.StatusNotAllowedByRuleSet},
+		{socks5.CmdUDPAssociate, "127.0.0.1:25", socks5.StatusNotAllowedByRuleSet},
+	}
+	for _, tc := range cases {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, tc.cmd, tc.addr)
+		conn.Close()
+		if rep != tc.want {
+			t.Fatalf("%s %s: want %q, but got %q", tc.cmd, tc.addr, tc.want, rep)
+		}
+		if got := <-calls; got != (call{tc.cmd, tc.addr}) {
+			t.Fatalf("want %+v, but got %+v", call{tc.cmd, tc.addr}, got)
+		}
+	}
+}
+
+func TestSocks5_RequestFilter(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		RequestFilter: func(req *server.Request) (bool, socks5.Reply) {
+			switch req.DestAddr.Port {
+			case 1:
+				return false, socks5.StatusHostUnreachable
+			case 2:
+				return false, socks5.StatusSucceeded
+			}
+			return true, socks5.StatusSucceeded
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("not dialed")
+		},
+	})
+
+	cases := []struct {
+		addr string
+		want socks5.Reply
+	}{
+		{"127.0.0.1:1", socks5.StatusHostUnreachable},
+		{"127.0.0.1:2", socks5.StatusNotAllowedByRuleSet},
+		{"127.0.0.1:3", socks5.StatusGeneralServerFailure},
+	}
+	for _, tc := range cases {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, tc.addr)
+		conn.Close()
+		if rep != tc.want {
+			t.Fatalf("%s: want %q, but got %q", tc.addr, tc.want, rep)
+		}
+	}
+}
+
+func TestSocks5_ConnRateLimit(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		ConnRateLimit: &server.ConnRateLimiter{Conns: 3, Interval: time.Minute},
+	})
+
+	var accepted int
+	for i := 0; i < 6; i++ {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte{socks5.Version, 1, byte(auth.MethodNotRequired)})
+		if _, err := io.ReadFull(conn, make([]byte, 2)); err == nil {
+			accepted++
+		}
+		conn.Close()
+	}
+	if accepted != 3 {
+		t.Fatalf("want 3 connections accepted, but got %d", accepted)
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails Accept with temporary errors n times.
+type flakyListener struct {
+	net.Listener
+	n int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.n, -1) >= 0 {
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestSocks5_AcceptErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := server.New(&server.Config{
+		AcceptRetryDelay:    time.Millisecond,
+		MaxAcceptRetryDelay: 2 * time.Millisecond,
+		Logger:              &fakeLogger{records: make(chan string, 10)},
+	})
+	go s.Serve(&flakyListener{Listener: ln, n: 3})
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	if got := s.AcceptErrors(); got != 3 {
+		t.Fatalf("want 3 accept errors, but got %d", got)
+	}
+}
+
+// noDelayConn records the values passed to SetNoDelay.
+type noDelayConn struct {
+	net.Conn
+	noDelay chan bool
+}
+
+func (c *noDelayConn) SetNoDelay(noDelay bool) error {
+	c.noDelay <- noDelay
+	return c.Conn.(*net.TCPConn).SetNoDelay(noDelay)
+}
+
+type noDelayListener struct {
+	net.Listener
+	noDelay chan bool
+}
+
+func (l *noDelayListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &noDelayConn{Conn: conn, noDelay: l.noDelay}, nil
+}
+
+func TestSocks5_NoDelay(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DisableNoDelay=%t", disable), func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			clientNoDelay, targetNoDelay := make(chan bool, 1), make(chan bool, 1)
+			s := server.New(&server.Config{
+				DisableNoDelay: disable,
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					var d net.Dialer
+					conn, err := d.DialContext(ctx, network, address)
+					if err != nil {
+						return nil, err
+					}
+					return &noDelayConn{Conn: conn, noDelay: targetNoDelay}, nil
+				},
+			})
+			go s.Serve(&noDelayListener{Listener: ln, noDelay: clientNoDelay})
+			echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			negotiate(t, conn, auth.MethodNotRequired)
+			rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+			if rep != socks5.StatusSucceeded {
+				t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+			}
+			for _, ch := range []chan bool{clientNoDelay, targetNoDelay} {
+				select {
+				case got := <-ch:
+					if got == disable {
+						t.Fatalf("want SetNoDelay(%t), but got SetNoDelay(%t)", !disable, got)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("SetNoDelay is not called")
+				}
+			}
+		})
+	}
+}
+
+func TestSocks5_IdleTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		IdleTimeout: timeout,
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		echoLn := echoConnectServer(t, "127.0.0.1:0")
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+		if rep != socks5.StatusSucceeded {
+			t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+		}
+		start := time.Now()
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("want connection to be closed, but got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < timeout/2 || elapsed > 2*time.Second {
+			t.Fatalf("want connection to be closed after %v, but got %v", timeout, elapsed)
+		}
+	})
+
+	t.Run("active", func(t *testing.T) {
+		// the destination only receives, so the relay is active in one
+		// direction.
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.Copy(ioutil.Discard, conn)
+		}()
+
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, ln.Addr().String())
+		if rep != socks5.StatusSucceeded {
+			t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+		}
+		for i := 0; i < 15; i++ {
+			if _, err := conn.Write([]byte{'x'}); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(timeout / 4)
+		}
+		// the relay stays open; reading it times out on the client side.
+		conn.SetReadDeadline(time.Now().Add(timeout / 4))
+		_, err = conn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("want the active connection to be kept, but got %v", err)
+		}
+	})
+}
+
+// keepAliveConn records the keep-alive period set on the connection,
+// which is zero if keep-alives are disabled.
+type keepAliveConn struct {
+	net.Conn
+	enabled bool
+	period  chan time.Duration
+}
+
+func (c *keepAliveConn) SetKeepAlive(keepAlive bool) error {
+	c.enabled = keepAlive
+	if !keepAlive {
+		c.period <- 0
+	}
+	return c.Conn.(*net.TCPConn).SetKeepAlive(keepAlive)
+}
+
+func (c *keepAliveConn) SetKeepAlivePeriod(d time.Duration) error {
+	if c.enabled {
+		c.period <- d
+	}
+	return c.Conn.(*net.TCPConn).SetKeepAlivePeriod(d)
+}
+
+type keepAliveListener struct {
+	net.Listener
+	period chan time.Duration
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &keepAliveConn{Conn: conn, period: l.period}, nil
+}
+
+func TestSocks5_KeepAlive(t *testing.T) {
+	for _, keepAlive := range []time.Duration{42 * time.Second, -1} {
+		t.Run(fmt.Sprintf("KeepAlive=%v", keepAlive), func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			clientPeriod, targetPeriod := make(chan time.Duration, 1), make(chan time.Duration, 1)
+			s := server.New(&server.Config{
+				KeepAlive: keepAlive,
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					var d net.Dialer
+					conn, err := d.DialContext(ctx, network, address)
+					if err != nil {
+						return nil, err
+					}
+					return &keepAliveConn{Conn: conn, period: targetPeriod}, nil
+				},
+			})
+			go s.Serve(&keepAliveListener{Listener: ln, period: clientPeriod})
+			echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			negotiate(t, conn, auth.MethodNotRequired)
+			rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+			if rep != socks5.StatusSucceeded {
+				t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+			}
+			want := keepAlive
+			if want < 0 {
+				want = 0
+			}
+			for _, ch := range []chan time.Duration{clientPeriod, targetPeriod} {
+				select {
+				case got := <-ch:
+					if got != want {
+						t.Fatalf("want keep-alive period %v, but got %v", want, got)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("keep-alive is not set")
+				}
+			}
+		})
+	}
+}
+
+func TestSocks5_RelayTimeout(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		RelayTimeout: timeout,
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+
+	// keep transferring until the relay is cut off.
+	start := time.Now()
+	buf := make([]byte, 1024)
+	for {
+		if _, err := conn.Write(buf); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("relay is not closed")
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < timeout/2 || elapsed > 2*time.Second {
+		t.Fatalf("want relay to be closed after %v, but got %v", timeout, elapsed)
+	}
+}
+
+func TestSocks5_MaxBytesPerConn(t *testing.T) {
+	const (
+		max  = 1000
+		sent = 600
+	)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		MaxBytesPerConn: max,
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+
+	// the echo of the sent bytes exceeds the limit.
+	if _, err := conn.Write(make([]byte, sent)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != max-sent {
+		t.Fatalf("want %d bytes to be relayed back, but got %d", max-sent, len(got))
+	}
+}
+
+func TestSocks5_MaxConnDuration(t *testing.T) {
+	const max = 300 * time.Millisecond
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		MaxConnDuration: max,
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	start := time.Now()
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+
+	// keep transferring until the connection is closed.
+	buf := make([]byte, 1024)
+	for {
+		if _, err := conn.Write(buf); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("connection is not closed")
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < max/2 || elapsed > 2*time.Second {
+		t.Fatalf("want connection to be closed after %v, but got %v", max, elapsed)
+	}
+}
+
+func TestSocks5_BufferSize(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		BufferSize: 512,
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+
+	data := make([]byte, 4<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		errCh <- err
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("relayed data is corrupted")
+	}
+}
+
+func TestSocks5_RateLimit(t *testing.T) {
+	const (
+		rate  = 100 * 1024
+		burst = 10 * 1024
+		size  = 100 * 1024
+	)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		RateLimit: &server.RateLimit{BytesPerSecond: rate, Burst: burst},
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+
+	start := time.Now()
+	go conn.Write(make([]byte, size))
+	if _, err := io.ReadFull(conn, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	// each direction is limited separately, so the echo takes about as
+	// long as sending the data once.
+	elapsed := time.Since(start)
+	min := time.Duration(size-burst) * time.Second / rate
+	if elapsed < min*9/10 || elapsed > min+2*time.Second {
+		t.Fatalf("want about %v to transfer %d bytes, but took %v", min, size, elapsed)
+	}
+}
+
+func TestSocks5_RateLimitRelayTimeout(t *testing.T) {
+	const timeout = 500 * time.Millisecond
+	closed := make(chan error, 1)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		// each wait for a burst goes past the deadline.
+		RateLimit:    &server.RateLimit{BytesPerSecond: 1024, Burst: 1024},
+		RelayTimeout: timeout,
+		OnClose: func(ctx context.Context, conn net.Conn, err error) {
+			closed <- err
+		},
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+
+	start := time.Now()
+	go conn.Write(make([]byte, 4*1024))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout*9/10 {
+		t.Fatalf("want relay to last %v, but closed after %v", timeout, elapsed)
+	}
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("want no error on close, but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose is not called")
+	}
+}
+
+func TestSocks5_GlobalRateLimit(t *testing.T) {
+	const (
+		rate  = 100 * 1024
+		burst = 10 * 1024
+		size  = 40 * 1024 // per connection
+		n     = 3
+	)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		GlobalRateLimit: &server.RateLimit{BytesPerSecond: rate, Burst: burst},
+	})
+
+	// the destination discards the data and closes the connection.
+	dstLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dstLn.Close()
+	go func() {
+		for {
+			conn, err := dstLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	start := time.Now()
+	errCh := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			if _, err := conn.Write([]byte{socks5.Version, 1, byte(auth.MethodNotRequired)}); err != nil {
+				errCh <- err
+				return
+			}
+			if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+				errCh <- err
+				return
+			}
+			port := dstLn.Addr().(*net.TCPAddr).Port
+			req := []byte{socks5.Version, byte(socks5.CmdConnect), 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)}
+			if _, err := conn.Write(req); err != nil {
+				errCh <- err
+				return
+			}
+			if _, err := io.ReadFull(conn, make([]byte, 10)); err != nil {
+				errCh <- err
+				return
+			}
+			if _, err := conn.Write(make([]byte, size)); err != nil {
+				errCh <- err
+				return
+			}
+			// the destination closes after reading everything.
+			conn.(*net.TCPConn).CloseWrite()
+			_, err = io.Copy(ioutil.Discard, conn)
+			errCh <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	min := time.Duration(n*size-burst) * time.Second / rate
+	if elapsed < min*9/10 {
+		t.Fatalf("want at least %v to transfer %d bytes in total, but took %v", min, n*size, elapsed)
+	}
+}
+
+func TestSocks5_MaxWorkers(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		MaxWorkers: 2,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, syscall.ECONNREFUSED
+		},
+	})
+
+	// busy workers hold the connections.
+	var busy []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		busy = append(busy, conn)
+	}
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Write([]byte{socks5.Version, 1, byte(auth.MethodNotRequired)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err == nil {
+		t.Fatal("want the connection to wait for a worker")
+	}
+
+	// the worker is reused when a connection finishes.
+	busy[0].Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if rep, _ := sendRequest(t, conn, socks5.CmdConnect, "127.0.0.1:80"); rep != socks5.StatusConnectionRefused {
+		t.Fatalf("want %q, but got %q", socks5.StatusConnectionRefused, rep)
+	}
+}
+
+func TestSocks5_MaxWorkersListeners(t *testing.T) {
+	s := server.New(&server.Config{MaxWorkers: 1})
+	defer s.Close()
+	var lns []net.Listener
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(ln)
+		lns = append(lns, ln)
+	}
+
+	busy, err := net.Dial("tcp", lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	busy.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, busy, auth.MethodNotRequired)
+
+	// the other listener shares the busy worker.
+	conn, err := net.Dial("tcp", lns[1].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Write([]byte{socks5.Version, 1, byte(auth.MethodNotRequired)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err == nil {
+		t.Fatal("want the connection to wait for a worker")
+	}
+
+	busy.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSocks5_ActiveConns(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := server.New(&server.Config{})
+	go s.Serve(ln)
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	const n = 3
+	var conns []net.Conn
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		conns = append(conns, conn)
+	}
+	// a relaying connection is also active.
+	rep, _ := sendRequest(t, conns[0], socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	if got := s.ActiveConns(); got != n {
+		t.Fatalf("want %d active connections, but got %d", n, got)
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.ActiveConns() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want no active connections, but got %d", s.ActiveConns())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSocks5_MaxConns(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := server.New(&server.Config{MaxConns: 2})
+	go s.Serve(ln)
+
+	// handshake reports whether the server has served the connection.
+	handshake := func() (net.Conn, bool) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte{socks5.Version, 1, byte(auth.MethodNotRequired)})
+		_, err = io.ReadFull(conn, make([]byte, 2))
+		return conn, err == nil
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, ok := handshake()
+		if !ok {
+			t.Fatalf("connection %d refused", i)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	if n := s.ActiveConns(); n != 2 {
+		t.Fatalf("want 2 active connections, but got %d", n)
+	}
+	conn, ok := handshake()
+	conn.Close()
+	if ok {
+		t.Fatal("want connection over the limit to be refused")
+	}
+
+	conns[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.ActiveConns() > 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed connection has not been released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, ok = handshake()
+	conn.Close()
+	if !ok {
+		t.Fatal("want connection to be served after a slot has been freed")
+	}
+}
+
+func TestSocks5_MaxConnsPerClient(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{MaxConnsPerClient: 1})
+
+	handshake := func(source string) (net.Conn, bool) {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(source)}}
+		conn, err := d.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte{socks5.Version, 1, byte(auth.MethodNotRequired)})
+		_, err = io.ReadFull(conn, make([]byte, 2))
+		return conn, err == nil
+	}
+
+	for _, client := range []string{"127.0.0.1", "127.0.0.2"} {
+		conn, ok := handshake(client)
+		if !ok {
+			t.Fatalf("%s: first connection refused", client)
+		}
+		defer conn.Close()
+
+		extra, ok := handshake(client)
+		extra.Close()
+		if ok {
+			t.Fatalf("%s: want second connection to be refused", client)
+		}
+	}
+}
+
+func TestSocks5_AccessSchedule(t *testing.T) {
+	var closed int32
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AccessSchedule: &server.AccessSchedule{
+			Windows: []server.TimeWindow{{Start: 9 * time.Hour, End: 17 * time.Hour}},
+			Now: func() time.Time {
+				if atomic.LoadInt32(&closed) == 1 {
+					return time.Date(2019, 10, 14, 18, 0, 0, 0, time.Local)
+				}
+				return time.Date(2019, 10, 14, 10, 0, 0, 0, time.Local)
+			},
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("not dialed")
+		},
+	})
+
+	for _, want := range []socks5.Reply{socks5.StatusGeneralServerFailure, socks5.StatusNotAllowedByRuleSet} {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, "127.0.0.1:80")
+		conn.Close()
+		if rep != want {
+			t.Fatalf("want %q, but got %q", want, rep)
+		}
+		atomic.StoreInt32(&closed, 1)
+	}
+}
+
+func TestSocks5_GeoIPPolicy(t *testing.T) {
+	_, blocked, _ := net.ParseCIDR("127.0.0.0/30")
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		GeoIPPolicy: func(ip net.IP) bool {
+			return !blocked.Contains(ip) && !ip.Equal(net.IPv6loopback)
+		},
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+	_, echoPort, _ := net.SplitHostPort(echoLn.Addr().String())
+
+	dial := func(source string) net.Conn {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(source)}}
+		conn, err := d.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	// the client in the blocked range is closed.
+	conn := dial("127.0.0.2")
+	conn.Write([]byte{socks5.Version, 1, byte(auth.MethodNotRequired)})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err == nil {
+		t.Fatal("want blocked client to be closed")
+	}
+	conn.Close()
+
+	for _, dst := range []string{
+		net.JoinHostPort("127.0.0.1", echoPort),
+		net.JoinHostPort("localhost", echoPort), // resolved to the blocked IPs
+	} {
+		conn := dial("127.0.0.5")
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, dst)
+		conn.Close()
+		if rep != socks5.StatusNotAllowedByRuleSet {
+			t.Fatalf("%s: want %q, but got %q", dst, socks5.StatusNotAllowedByRuleSet, rep)
+		}
+	}
+
+	allowedLn := echoConnectServer(t, "127.0.0.5:0")
+	conn = dial("127.0.0.5")
+	defer conn.Close()
+	negotiate(t, conn, auth.MethodNotRequired)
+	if rep, _ := sendRequest(t, conn, socks5.CmdConnect, allowedLn.Addr().String()); rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+}
+
+type fakeResolver map[string][]net.IPAddr
+
+func (r fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestSocks5_Resolver(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		Resolver: fakeResolver{
+			"echo.internal": {{IP: net.IPv4(127, 0, 0, 1)}},
+		},
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+	_, echoPort, _ := net.SplitHostPort(echoLn.Addr().String())
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, net.JoinHostPort("echo.internal", echoPort))
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "hello", string(buf); want != got {
+		t.Fatalf("want %q, but got %q", want, got)
+	}
+}
+
+type countingResolver struct {
+	fakeResolver
+	lookups int32
+}
+
+func (r *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	return r.fakeResolver.LookupIPAddr(ctx, host)
+}
+
+func TestSocks5_DNSCache(t *testing.T) {
+	resolver := &countingResolver{
+		fakeResolver: fakeResolver{"a.example": {{IP: net.ParseIP("192.0.2.1")}}},
+	}
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		Resolver:    resolver,
+		DNSCacheTTL: time.Minute,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("not dialed")
+		},
+	})
+
+	for _, host := range []string{"a.example", "A.example", "missing.example", "missing.example"} {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		sendRequest(t, conn, socks5.CmdConnect, net.JoinHostPort(host, "80"))
+		conn.Close()
+	}
+	if want, got := int32(2), atomic.LoadInt32(&resolver.lookups); want != got {
+		t.Fatalf("want %d lookups, but got %d", want, got)
+	}
+}
+
+func TestSocks5_ResolveFunc(t *testing.T) {
+	dialed := make(chan string, 1)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		Resolver: fakeResolver{"svc.internal": {{IP: net.ParseIP("192.0.2.1")}}},
+		ResolveFunc: func(ctx context.Context, host string) ([]net.IP, error) {
+			if host == "svc.internal" {
+				return []net.IP{net.IPv4(127, 0, 0, 2)}, nil
+			}
+			return nil, nil
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed <- address
+			return nil, errors.New("not dialed")
+		},
+	})
+
+	cases := []struct {
+		host string
+		want socks5.Reply
+	}{
+		{"svc.internal", socks5.StatusGeneralServerFailure},
+		{"unknown.internal", socks5.StatusHostUnreachable},
+	}
+	for _, tc := range cases {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, net.JoinHostPort(tc.host, "80"))
+		conn.Close()
+		if rep != tc.want {
+			t.Fatalf("%s: want %q, but got %q", tc.host, tc.want, rep)
+		}
+	}
+
+	if want, got := "127.0.0.2:80", <-dialed; want != got {
+		t.Fatalf("want dialed address %s, but got %s", want, got)
+	}
+}
+
+type fakeLogger struct {
+	records chan string
+}
+
+func (l *fakeLogger) Debugf(format string, v ...interface{}) {
+	l.records <- "debug: " + fmt.Sprintf(format, v...)
+}
+
+func (l *fakeLogger) Infof(format string, v ...interface{}) {
+	l.records <- "info: " + fmt.Sprintf(format, v...)
+}
+
+func (l *fakeLogger) Errorf(format string, v ...interface{}) {
+	l.records <- "error: " + fmt.Sprintf(format, v...)
+}
+
+func TestSocks5_Logger(t *testing.T) {
+	logger := &fakeLogger{records: make(chan string, 10)}
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		Logger: logger,
+	})
+
+	// an unsupported version fails the connection.
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{4, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case record := <-logger.records:
+		if !strings.HasPrefix(record, "error: socks5: error(tcp)") {
+			t.Fatalf("unexpected record %q", record)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record has been logged")
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSocks5_DebugErrorLog(t *testing.T) {
+	var buf syncBuffer
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		Debug:    true,
+		ErrorLog: log.New(&buf, "", 0),
+	})
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+
+	// the dump is written without Logger.
+	want := "write: 05 00\n"
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(buf.String(), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %q to be logged, but got %q", want, buf.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSocks5_DefaultLoggerDone(t *testing.T) {
+	var buf syncBuffer
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		ErrorLog: log.New(&buf, "", 0),
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	conn.Close()
+
+	// the end of the connection is logged without Logger and Debug.
+	want := "socks5: done tcp serve"
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(buf.String(), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %q to be logged, but got %q", want, buf.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSocks5_Debug(t *testing.T) {
+	logger := &fakeLogger{records: make(chan string, 100)}
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		Debug:  true,
+		Logger: logger,
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	if _, err := conn.Write([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	var logged []string
+	for {
+		select {
+		case record := <-logger.records:
+			logged = append(logged, record)
+			if !strings.HasPrefix(record, "info: socks5: done") {
+				continue
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out with %q", logged)
+		}
+		break
+	}
+	all := strings.Join(logged, "\n")
+	for _, want := range []string{
+		"write: 05 00\n",                 // method selection
+		"read: 05 01 00\n",               // request
+		"write: 05 00 00 01 7f 00 00 01", // reply
+	} {
+		if !strings.Contains(all, want) {
+			t.Errorf("want %q in the log, but got %q", want, all)
+		}
+	}
+	if secret := fmt.Sprintf("% x", "secret"); strings.Contains(all, secret) {
+		t.Errorf("relayed data is logged: %q", all)
+	}
+}
+
+func TestSocks5_ErrorLog(t *testing.T) {
+	var buf syncBuffer
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		ErrorLog: log.New(&buf, "proxy: ", 0),
+	})
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{4, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if got := buf.String(); got != "" {
+			if !strings.HasPrefix(got, "proxy: socks5: error(tcp)") {
+				t.Fatalf("unexpected log %q", got)
 			}
-			defer conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no error has been logged")
+		}
+	}
+}
 
-			want := "OK"
-			if _, err := conn.Write([]byte(want)); err != nil {
-				t.Fatal(err)
-			}
+func TestSocks5_ConnState(t *testing.T) {
+	states := make(chan server.ConnState, 10)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		ConnState: func(conn net.Conn, state server.ConnState) {
+			states <- state
+		},
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
 
-			buf := make([]byte, 2)
-			if _, err := conn.Read(buf); err != nil {
-				t.Fatal(err)
-			}
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	conn.Close()
 
-			got := string(buf)
-			if want != got {
-				t.Fatalf(`want %s, but got %s`, want, got)
+	want := []server.ConnState{
+		server.StateNew,
+		server.StateActive,
+		server.StateRelaying,
+		server.StateClosed,
+	}
+	for _, w := range want {
+		select {
+		case got := <-states:
+			if got != w {
+				t.Fatalf("want state %s, but got %s", w, got)
 			}
-		})
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for state %s", w)
+		}
 	}
 }
 
-func TestSocks5_Bind(t *testing.T) {
-	for _, address := range addressCase {
-		t.Run(address, func(t *testing.T) {
-			socks5Ln := socks5Server(t, address)
-			ctx := context.Background()
-			socks5Addr := socks5Ln.Addr()
+func TestSocks5_AccessLog(t *testing.T) {
+	records := make(chan *server.AccessRecord, 1)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AccessLog: func(rec *server.AccessRecord) {
+			records <- rec
+		},
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
 
-			dialer, err := proxy.Socks5(ctx, socks5.CmdConnect, socks5Addr.Network(), socks5Addr.String())
-			if err != nil {
-				t.Fatal(err)
-			}
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	if _, err := conn.Write([]byte("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
 
-			echoLn, waitCh := echoBindServer(t, address)
-			echoAddr := echoLn.Addr()
-			conn1, err := dialer.Dial(echoAddr.Network(), echoAddr.String())
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer conn1.Close()
+	var rec *server.AccessRecord
+	select {
+	case rec = <-records:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no access record")
+	}
+	if rec.Command != socks5.CmdConnect || rec.Reply != socks5.StatusSucceeded {
+		t.Fatalf("unexpected command %s and reply %s", rec.Command, rec.Reply)
+	}
+	if want, got := echoLn.Addr().String(), rec.DestAddr.String(); want != got {
+		t.Fatalf("want destination %s, but got %s", want, got)
+	}
+	if want, got := conn.LocalAddr().String(), rec.RemoteAddr.String(); want != got {
+		t.Fatalf("want remote address %s, but got %s", want, got)
+	}
+	if rec.BytesSent != 12 || rec.BytesReceived != 12 {
+		t.Fatalf("want 12 bytes sent and received, but got %d and %d", rec.BytesSent, rec.BytesReceived)
+	}
+}
 
-			dialer2, err := proxy.Socks5(ctx, socks5.CmdBind, socks5Addr.Network(), socks5Addr.String())
-			if err != nil {
-				t.Fatal(err)
+func TestSocks5_ConnID(t *testing.T) {
+	connected := make(chan uint64, 2)
+	records := make(chan *server.AccessRecord, 2)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		OnConnect: func(ctx context.Context, conn net.Conn) {
+			id, ok := server.ConnIDFromContext(ctx)
+			if !ok {
+				t.Error("no connection ID in OnConnect")
 			}
+			connected <- id
+		},
+		AccessLog: func(rec *server.AccessRecord) {
+			records <- rec
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("not dialed")
+		},
+	})
 
-			ln, err := dialer2.Listen("tcp", address)
-			if err != nil {
-				t.Fatal(err)
-			}
-			addr := ln.Addr()
-			_, err = conn1.Write([]byte(addr.String() + "\n"))
-			if err != nil {
-				t.Fatal(err)
-			}
+	var ids []uint64
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		sendRequest(t, conn, socks5.CmdConnect, "example.com:80")
+		conn.Close()
 
-			// wait to dial tcp from echo bind server
-			<-waitCh
+		id := <-connected
+		if rec := <-records; rec.ConnID != id {
+			t.Fatalf("want connection ID %d in the access record, but got %d", id, rec.ConnID)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] == ids[1] {
+		t.Fatalf("want unique connection IDs, but got %d twice", ids[0])
+	}
+}
 
-			want := "OK"
-			_, err = conn1.Write([]byte(want))
-			if err != nil {
-				t.Fatal(err)
-			}
+func TestSocks5_AccessLogTiming(t *testing.T) {
+	const (
+		resolveDelay = 100 * time.Millisecond
+		dialDelay    = 200 * time.Millisecond
+	)
+	records := make(chan *server.AccessRecord, 1)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AccessLog: func(rec *server.AccessRecord) {
+			records <- rec
+		},
+		ResolveFunc: func(ctx context.Context, host string) ([]net.IP, error) {
+			time.Sleep(resolveDelay)
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			time.Sleep(dialDelay)
+			return nil, syscall.ECONNREFUSED
+		},
+	})
 
-			conn2, err := ln.Accept()
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer conn2.Close()
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	sendRequest(t, conn, socks5.CmdConnect, "slow.example:80")
 
-			buf := make([]byte, 2)
-			if _, err := conn2.Read(buf); err != nil {
-				t.Fatal(err)
+	rec := <-records
+	if d := rec.ResolveDuration; d < resolveDelay || d > resolveDelay+time.Second {
+		t.Errorf("want resolve duration about %v, but got %v", resolveDelay, d)
+	}
+	if d := rec.DialDuration; d < dialDelay || d > dialDelay+time.Second {
+		t.Errorf("want dial duration about %v, but got %v", dialDelay, d)
+	}
+	if rec.AuthDuration <= 0 {
+		t.Errorf("want auth duration, but got %v", rec.AuthDuration)
+	}
+}
+
+func TestSocks5_OnTransfer(t *testing.T) {
+	type transfer struct{ up, down int64 }
+	transfers := make(chan transfer, 1)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		OnTransfer: func(up, down int64) {
+			transfers <- transfer{up, down}
+		},
+	})
+
+	// the destination reads 1000 bytes and answers 3 bytes.
+	dstLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dstLn.Close()
+	go func() {
+		conn, err := dstLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.CopyN(ioutil.Discard, conn, 1000)
+		conn.Write([]byte("bye"))
+	}()
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, dstLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	if _, err := conn.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case got := <-transfers:
+		if got.up != 1000 || got.down != 3 {
+			t.Fatalf("want 1000 bytes up and 3 bytes down, but got %d and %d", got.up, got.down)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnTransfer has not been called")
+	}
+}
+
+func TestSocks5_OnConnectOnClose(t *testing.T) {
+	connected := make(chan net.Conn, 10)
+	closed := make(chan error, 10)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		AuthMethods: map[auth.Method]auth.Authenticator{
+			auth.MethodUsernamePassword: &server.UsernamePassword{
+				Check: server.NewStaticCredentials(map[string]string{"user": "pass"}).Check,
+			},
+		},
+		OnConnect: func(ctx context.Context, conn net.Conn) {
+			connected <- conn
+		},
+		OnClose: func(ctx context.Context, conn net.Conn, err error) {
+			closed <- err
+		},
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+
+	expect := func(wantErr error) {
+		t.Helper()
+		select {
+		case <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("OnConnect has not been called")
+		}
+		select {
+		case err := <-closed:
+			if wantErr == nil && err != nil || wantErr != nil && !errors.Is(err, wantErr) {
+				t.Fatalf("want error %v, but got %v", wantErr, err)
 			}
-			got := string(buf)
-			if want != got {
-				t.Fatalf("want %s, but got %s", want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("OnClose has not been called")
+		}
+		select {
+		case <-connected:
+			t.Fatal("OnConnect has been called more than once")
+		case <-closed:
+			t.Fatal("OnClose has been called more than once")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// authentication fails.
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodUsernamePassword)
+	conn.Write([]byte{1, 4, 'u', 's', 'e', 'r', 5, 'w', 'r', 'o', 'n', 'g'})
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
+	expect(auth.ErrAuthenticationFailed)
+
+	// a successful CONNECT.
+	conn, err = net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodUsernamePassword)
+	conn.Write([]byte{1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'})
+	io.ReadFull(conn, make([]byte, 2))
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	conn.Close()
+	expect(nil)
+}
+
+type spanKey struct{}
+
+type fakeSpan struct {
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	ended chan struct{}
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *fakeSpan) End() { close(s.ended) }
+
+type fakeTracer struct {
+	spans chan *fakeSpan
+}
+
+func (tr *fakeTracer) Start(ctx context.Context, name string) (context.Context, server.Span) {
+	span := &fakeSpan{attrs: make(map[string]interface{}), ended: make(chan struct{})}
+	tr.spans <- span
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func TestSocks5_Tracer(t *testing.T) {
+	tracer := &fakeTracer{spans: make(chan *fakeSpan, 1)}
+	dialedSpan := make(chan interface{}, 1)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		Tracer: tracer,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialedSpan <- ctx.Value(spanKey{})
+			return nil, syscall.ECONNREFUSED
+		},
+	})
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	if rep, _ := sendRequest(t, conn, socks5.CmdConnect, "example.com:80"); rep != socks5.StatusConnectionRefused {
+		t.Fatalf("want %q, but got %q", socks5.StatusConnectionRefused, rep)
+	}
+
+	span := <-tracer.spans
+	select {
+	case <-span.ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("span has not ended")
+	}
+	if got := <-dialedSpan; got != span {
+		t.Fatal("span has not been propagated to DialContext")
+	}
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	for key, want := range map[string]interface{}{
+		"socks5.command":     socks5.CmdConnect.String(),
+		"socks5.destination": "example.com:80",
+		"socks5.reply":       int(socks5.StatusConnectionRefused),
+	} {
+		if got := span.attrs[key]; got != want {
+			t.Errorf("%s: want %v, but got %v", key, want, got)
+		}
+	}
+	if _, ok := span.attrs["socks5.duration"].(time.Duration); !ok {
+		t.Errorf("want socks5.duration, but got %v", span.attrs["socks5.duration"])
+	}
+}
+
+func TestSocks5_ResolveFailure(t *testing.T) {
+	notFound := func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(address)
+		return nil, &net.OpError{
+			Op:  "dial",
+			Net: network,
+			Err: &net.DNSError{Err: "no such host", Name: host, IsNotFound: true},
+		}
+	}
+	configs := map[string]*server.Config{
+		// resolved by the server.
+		"Resolver": {Resolver: fakeResolver{}, DialContext: notFound},
+		// resolved by DialContext.
+		"DialContext": {DialContext: notFound},
+	}
+	for name, c := range configs {
+		socks5Ln := socks5Server(t, "127.0.0.1:0", c)
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, "nxdomain.example:80")
+		conn.Close()
+		if rep != socks5.StatusHostUnreachable {
+			t.Fatalf("%s: want %q, but got %q", name, socks5.StatusHostUnreachable, rep)
+		}
+	}
+}
+
+func TestSocks5_ResolveTimeout(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		ResolveTimeout: 100 * time.Millisecond,
+		ResolveFunc: func(ctx context.Context, host string) ([]net.IP, error) {
+			// the resolver hangs.
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			t.Errorf("unexpected dial to %q", address)
+			return nil, errors.New("not dialed")
+		},
+	})
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, "slow.example:80")
+	if rep != socks5.StatusHostUnreachable {
+		t.Fatalf("want %q, but got %q", socks5.StatusHostUnreachable, rep)
+	}
+}
+
+func TestSocks5_DialTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		DialTimeout: timeout,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// the destination never answers.
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	start := time.Now()
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, "192.0.2.1:80")
+	if rep != socks5.StatusTTLExpired {
+		t.Fatalf("want %q, but got %q", socks5.StatusTTLExpired, rep)
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 2*time.Second {
+		t.Fatalf("want the dial to time out after %v, but got %v", timeout, elapsed)
+	}
+}
+
+func TestSocks5_DialRetries(t *testing.T) {
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+	var attempts int32
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		DialRetries:    2,
+		DialRetryDelay: time.Millisecond,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				// the destination is restarting.
+				return nil, syscall.ECONNREFUSED
 			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	})
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, echoLn.Addr().String())
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 2 {
+		t.Fatalf("want 2 attempts, but got %d", got)
+	}
+}
+
+func TestSocks5_AddressFamily(t *testing.T) {
+	v4 := net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+	v6 := net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	resolver := fakeResolver{
+		"a.example":    {v4},
+		"aaaa.example": {v6},
+		"both.example": {v6, v4},
+	}
+
+	cases := []struct {
+		family server.AddressFamily
+		host   string
+		want   socks5.Reply
+		dialed string
+	}{
+		{server.AddressFamilyIPv4, "a.example", socks5.StatusGeneralServerFailure, "192.0.2.1:80"},
+		{server.AddressFamilyIPv4, "aaaa.example", socks5.StatusHostUnreachable, ""},
+		{server.AddressFamilyIPv4, "both.example", socks5.StatusGeneralServerFailure, "192.0.2.1:80"},
+		{server.AddressFamilyIPv6, "a.example", socks5.StatusHostUnreachable, ""},
+		{server.AddressFamilyIPv6, "both.example", socks5.StatusGeneralServerFailure, "[2001:db8::1]:80"},
+	}
+	for _, tc := range cases {
+		dialed := make(chan string, 2)
+		socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+			Resolver:      resolver,
+			AddressFamily: tc.family,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dialed <- address
+				return nil, errors.New("not dialed")
+			},
 		})
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, net.JoinHostPort(tc.host, "80"))
+		conn.Close()
+		if rep != tc.want {
+			t.Fatalf("%s %s: want %q, but got %q", tc.family, tc.host, tc.want, rep)
+		}
+		close(dialed)
+		var got []string
+		for addr := range dialed {
+			got = append(got, addr)
+		}
+		if tc.dialed == "" && len(got) != 0 || tc.dialed != "" && (len(got) != 1 || got[0] != tc.dialed) {
+			t.Fatalf("%s %s: want dialed %q, but got %q", tc.family, tc.host, tc.dialed, got)
+		}
+	}
+}
+
+func TestSocks5_HappyEyeballs(t *testing.T) {
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+	_, echoPort, _ := net.SplitHostPort(echoLn.Addr().String())
+	canceled := make(chan struct{})
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		HappyEyeballs: true,
+		Resolver: fakeResolver{
+			"dual.example": {{IP: net.ParseIP("2001:db8::1")}, {IP: net.IPv4(127, 0, 0, 1)}},
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if strings.HasPrefix(address, "[2001:db8::1]") {
+				// the IPv6 path is broken.
+				<-ctx.Done()
+				close(canceled)
+				return nil, ctx.Err()
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	})
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	negotiate(t, conn, auth.MethodNotRequired)
+	start := time.Now()
+	rep, _ := sendRequest(t, conn, socks5.CmdConnect, net.JoinHostPort("dual.example", echoPort))
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("want connected via IPv4 promptly, but took %v", elapsed)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("IPv6 attempt has not been canceled")
+	}
+}
+
+func TestSocks5_ResolveBeforeDial(t *testing.T) {
+	dialed := make(chan string, 1)
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		ResolveBeforeDial: true,
+		Resolver: fakeResolver{
+			"loopback.example": {{IP: net.IPv4(127, 0, 0, 1)}},
+			"www.example":      {{IP: net.ParseIP("192.0.2.1")}},
+		},
+		RuleSet: &server.RuleSet{
+			Rules:   []server.Rule{{Action: server.Deny, Hosts: []string{"127.0.0.0/8"}}},
+			Default: server.Allow,
+		},
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed <- address
+			return nil, errors.New("not dialed")
+		},
+	})
+
+	cases := []struct {
+		host string
+		want socks5.Reply
+	}{
+		{"loopback.example", socks5.StatusNotAllowedByRuleSet},
+		{"www.example", socks5.StatusGeneralServerFailure},
+	}
+	for _, tc := range cases {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, net.JoinHostPort(tc.host, "80"))
+		conn.Close()
+		if rep != tc.want {
+			t.Fatalf("%s: want %q, but got %q", tc.host, tc.want, rep)
+		}
+	}
+
+	// only the allowed IP has been dialed.
+	if want, got := "192.0.2.1:80", <-dialed; want != got {
+		t.Fatalf("want dialed address %s, but got %s", want, got)
+	}
+}
+
+func TestSocks5_DenyPrivateNetworks(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		DenyPrivateNetworks: true,
+	})
+	echoLn := echoConnectServer(t, "127.0.0.1:0")
+	_, echoPort, _ := net.SplitHostPort(echoLn.Addr().String())
+	echoAddr := echoUdpServer(t, "127.0.0.1:0")
+
+	for _, dst := range []string{
+		net.JoinHostPort("127.0.0.1", echoPort),
+		net.JoinHostPort("localhost", echoPort), // resolved to loopback
+		net.JoinHostPort("::1", echoPort),
+	} {
+		conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		negotiate(t, conn, auth.MethodNotRequired)
+		rep, _ := sendRequest(t, conn, socks5.CmdConnect, dst)
+		conn.Close()
+		if rep != socks5.StatusNotAllowedByRuleSet {
+			t.Fatalf("%s: want %q, but got %q", dst, socks5.StatusNotAllowedByRuleSet, rep)
+		}
+	}
+
+	// datagrams to private destinations are not relayed.
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, relay := udpAssociate(t, socks5Ln.Addr(), client.LocalAddr())
+	defer conn.Close()
+	if _, err := client.WriteTo(udpFrame(t, echoAddr, []byte("OK")), relay); err != nil {
+		t.Fatal(err)
+	}
+	expectNoDatagram(t, client)
+}
+
+func TestSocks5_BindTimeout(t *testing.T) {
+	socks5Ln := socks5Server(t, "127.0.0.1:0", &server.Config{
+		BindTimeout: 200 * time.Millisecond,
+	})
+
+	conn, err := net.Dial("tcp", socks5Ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	negotiate(t, conn, auth.MethodNotRequired)
+	rep, bnd := sendRequest(t, conn, socks5.CmdBind, "127.0.0.1:0")
+	if rep != socks5.StatusSucceeded {
+		t.Fatalf("want %q, but got %q", socks5.StatusSucceeded, rep)
+	}
+
+	// no peer connects, so the second reply reports the failure.
+	if rep, _ := readReply(t, conn); rep != socks5.StatusHostUnreachable {
+		t.Fatalf("want %q, but got %q", socks5.StatusHostUnreachable, rep)
+	}
+	if c, err := net.Dial("tcp", bnd.String()); err == nil {
+		c.Close()
+		t.Fatal("expected listener to be closed")
 	}
 }
 
-func socks5Server(t *testing.T, address string) net.Listener {
+func socks5Server(t *testing.T, address string, c *server.Config) net.Listener {
 	t.Helper()
 	socks5Ln, err := net.Listen("tcp", address)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	go func() {
-		if err := server.New(nil).Serve(socks5Ln); err != nil {
+		if err := server.New(c).Serve(socks5Ln); err != nil {
 			panic(err)
 		}
 	}()
@@ -172,7 +4387,7 @@ func socks5Server(t *testing.T, address string) net.Listener {
 
 func echoConnectServer(t *testing.T, address string) net.Listener {
 	t.Helper()
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	ln, err := net.Listen("tcp", address)
 	if err != nil {
 		t.Fatal(err)
 	}